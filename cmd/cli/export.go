@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/eldius/docker-profiler/internal/export"
+	"github.com/eldius/docker-profiler/internal/persistence"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// exportCmd writes the datapoints of sessions to a CSV, NDJSON or Parquet
+// file.
+func exportCmd(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	var sessionIDs stringList
+	fs.Var(&sessionIDs, "session", "Session to be exported (repeat it or use a comma separated list for more than one, defaults to the latest)")
+	var containers stringList
+	fs.Var(&containers, "container", "Container name or ID prefix to be exported (repeat it or use a comma separated list for more than one)")
+	var from, to timeValue
+	fs.Var(&from, "from", "Export datapoints from the time (RFC3339, or a duration relative to now like `-15m`)")
+	fs.Var(&to, "to", "Export datapoints up to the time (RFC3339, or a duration relative to now like `-5m`)")
+	resolution := resolutionValue{persistence.Raw}
+	fs.Var(&resolution, "resolution", "Resolution of the exported datapoints: raw, 1m, 5m or auto (auto picks the finest one fitting the range)")
+	aggregate := aggregateValue{persistence.Avg}
+	fs.Var(&aggregate, "aggregate", "Value of the downsampled datapoints exported: avg, min, max or p95")
+	format := fs.String("format", "", "Output format: csv, ndjson or parquet (defaults to the output file extension, or csv)")
+	output := fs.String("o", "", "Output file (defaults to stdout)")
+	registerDataDirFlag(fs)
+
+	_ = fs.Parse(args)
+
+	name := *format
+	if name == "" {
+		name = strings.TrimPrefix(filepath.Ext(*output), ".")
+	}
+	if name == "" {
+		name = string(export.CSV)
+	}
+	f, err := export.ParseFormat(name)
+	if err != nil {
+		log.Fatalf("invalid format: %v", err)
+	}
+
+	list, err := listSessions(sessionIDs, persistence.ListOptions{
+		From:       from.Time,
+		To:         to.Time,
+		Containers: containers,
+		Resolution: resolution.Resolution,
+		Aggregate:  aggregate.Aggregate,
+	})
+	if err != nil {
+		log.Fatalf("failed to list datapoints: %v", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("failed to create output file: %v", err)
+		}
+		defer func() {
+			if err := file.Close(); err != nil {
+				log.Fatalf("failed to close output file: %v", err)
+			}
+		}()
+		w = file
+	}
+
+	if err := export.Write(w, f, list); err != nil {
+		log.Fatalf("failed to export datapoints: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/eldius/docker-profiler/internal/model"
+	"github.com/eldius/docker-profiler/internal/persistence"
+	"io"
+	"log"
+	"os"
+)
+
+// importCmd persists a capture of the daemon stats stream into a new
+// session.
+func importCmd(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import [flags] FILE\n\nFILE holds newline-delimited stats documents (eg: `curl --unix-socket /var/run/docker.sock http://localhost/containers/ID/stats`), use - for stdin.\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	name := fs.String("container", "", "Container name (and ID) for the documents missing them")
+	note := fs.String("note", "", "Free-form note about the session")
+	storage := storageValue{persistence.TStorage}
+	fs.Var(&storage, "storage", "Storage backend of the session datapoints (tstorage or sqlite)")
+	retention := fs.Duration("retention", 0, "How long the raw datapoints are kept once downsampled into 1m/5m rollups, back from the latest datapoint rather than from now (0 keeps them, at least 15m, sqlite storage only)")
+	registerDataDirFlag(fs)
+	throttlingThreshold := fs.Float64("throttling-threshold", defaultThrottlingThreshold, "Throttled periods percentage above which the summary flags a session")
+
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var in io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("failed to open stats file: %v", err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		in = f
+	}
+
+	r, err := persistence.NewSession(persistence.SessionOptions{
+		Args:      os.Args[1:],
+		Note:      *note,
+		Storage:   storage.StorageKind,
+		Retention: *retention,
+	})
+	if err != nil {
+		log.Fatalf("failed to create session: %v", err)
+	}
+	fmt.Println("session:", r.Session().ID)
+
+	count, err := r.Import(in, model.Container{ID: *name, Name: *name})
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatalf("failed to import stats: %v", err)
+	}
+	fmt.Println("imported:", count)
+
+	printSummary(r.Session(), *throttlingThreshold)
+}
@@ -6,60 +6,426 @@ import (
 	"flag"
 	"fmt"
 	"github.com/eldius/docker-profiler/internal/docker"
+	"github.com/eldius/docker-profiler/internal/helper"
+	"github.com/eldius/docker-profiler/internal/model"
+	"github.com/eldius/docker-profiler/internal/persistence"
 	"github.com/eldius/docker-profiler/internal/plot"
+	"github.com/eldius/docker-profiler/internal/report"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 )
 
+const (
+	defaultThrottlingThreshold = 10.0
+
+	// outDirEnv names the environment variable setting the charts
+	// directory.
+	outDirEnv = "DOCKER_PROFILER_OUT_DIR"
+)
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "run":
+			runCmd(os.Args[2:])
+			return
+		case "sessions":
+			sessionsCmd(os.Args[2:])
+			return
+		case "export":
+			exportCmd(os.Args[2:])
+			return
+		case "import":
+			importCmd(os.Args[2:])
+			return
+		case "replay":
+			replayCmd(os.Args[2:])
+			return
+		case "serve":
+			serveCmd(os.Args[2:])
+			return
+		}
+	}
 
-	containerName := flag.String("container", "", "Container name to be profiled")
+	var containerNames stringList
+	flag.Var(&containerNames, "container", "Container name to be profiled, or name/ID prefix to be plotted (repeat it or use a comma separated list for more than one)")
+	var labels stringList
+	flag.Var(&labels, "label", "Profile containers with the label (`key` or `key=value`, can be repeated)")
+	image := flag.String("image", "", "Profile containers created from the image")
+	composeProject := flag.String("compose-project", "", "Profile containers of the docker compose project")
+	composeService := flag.String("compose-service", "", "Profile containers of the docker compose service")
+	follow := flag.Bool("follow", false, "Keep profiling matching containers started later, until interrupted")
+	interval := flag.Duration("interval", 0, "Sampling interval, polling one-shot stats instead of the daemon stats stream (~1s)")
+	duration := flag.Duration("duration", 0, "Stop profiling after the given duration (0 means no limit)")
+	untilExit := flag.Bool("until-exit", false, "Stop following once every profiled container has exited")
+	record := flag.String("record", "", "Save every raw stats document received to the file, as newline-delimited JSON")
+	note := flag.String("note", "", "Free-form note about the profiling session")
+	persist := flag.Bool("persist", true, "Record the stats in a profiling session (disable it to only export them with -otlp)")
+	storage := storageValue{persistence.TStorage}
+	flag.Var(&storage, "storage", "Storage backend of the session datapoints (tstorage or sqlite)")
+	retention := flag.Duration("retention", 0, "How long the raw datapoints are kept once downsampled into 1m/5m rollups, back from the latest datapoint rather than from now (0 keeps them, at least 15m, sqlite storage only)")
+	otlp := registerOTLPFlags(flag.CommandLine)
+	throttlingThreshold := flag.Float64("throttling-threshold", defaultThrottlingThreshold, "Throttled periods percentage above which the summary flags a session")
+	var sessionIDs stringList
+	flag.Var(&sessionIDs, "session", "Session to be plotted (repeat it or use a comma separated list for more than one, defaults to the latest)")
+	var from, to timeValue
+	flag.Var(&from, "from", "Plot datapoints from the time (RFC3339, or a duration relative to now like `-15m`)")
+	flag.Var(&to, "to", "Plot datapoints up to the time (RFC3339, or a duration relative to now like `-5m`)")
+	resolution := resolutionValue{persistence.Auto}
+	flag.Var(&resolution, "resolution", "Resolution of the plotted datapoints: auto, raw, 1m or 5m (auto picks the finest one fitting the range)")
+	aggregate := aggregateValue{persistence.Avg}
+	flag.Var(&aggregate, "aggregate", "Value of the downsampled datapoints plotted: avg, min, max or p95")
+	registerDataDirFlag(flag.CommandLine)
+	outDir := flag.String("out-dir", "", "Directory the charts are written to (defaults to $"+outDirEnv+", or charts under the data directory)")
 	profile := flag.Bool("profile", false, "Profile containers")
-	plotChart := flag.Bool("plot", false, "Profile containers")
+	plotChart := flag.Bool("plot", false, "Plot the session charts and print their summary (the sessions given with -session, or the latest one)")
 
 	flag.Parse()
 
-	fmt.Println("containerName:", *containerName)
-	if *containerName == "" {
-		panic(errors.New("invalid container name"))
+	sel := docker.Selector{
+		Names:          containerNames,
+		Labels:         labels,
+		Image:          *image,
+		ComposeProject: *composeProject,
+		ComposeService: *composeService,
 	}
-	fmt.Println("profile:", *profile)
 
-	c, err := docker.NewClient(*containerName)
-	if err != nil {
-		log.Fatalf("failed to create client: %v", err)
-	}
+	fmt.Println("containerName:", containerNames.String())
+	fmt.Println("profile:", *profile)
 
 	if *profile {
-		ctx := context.Background()
+		if sel.IsEmpty() {
+			panic(errors.New("invalid container selection"))
+		}
 
-		if err := c.GetRuntimeStatistcs(ctx, *containerName); err != nil {
+		var r *persistence.Repository
+		if *persist {
+			var err error
+			r, err = persistence.NewSession(persistence.SessionOptions{
+				Args:      os.Args[1:],
+				Note:      *note,
+				Interval:  *interval,
+				Storage:   storage.StorageKind,
+				Retention: *retention,
+			})
+			if err != nil {
+				log.Fatalf("failed to create session: %v", err)
+			}
+			fmt.Println("session:", r.Session().ID)
+		}
+
+		c, err := docker.NewClient(r)
+		if err != nil {
+			log.Fatalf("failed to create client: %v", err)
+		}
+
+		ctx, cancel := profilingContext(*duration)
+		defer cancel()
+
+		exporter := otlp.exporter(ctx)
+		opts := docker.ProfileOptions{
+			Follow:    *follow,
+			Interval:  *interval,
+			UntilExit: *untilExit,
+			Sinks:     sinks(exporter),
+		}
+		if *record != "" {
+			f, err := os.Create(*record)
+			if err != nil {
+				log.Fatalf("failed to create record file: %v", err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			opts.Record = f
+		}
+		err = c.GetRuntimeStatistcs(ctx, sel, opts)
+		closeExporter(exporter)
+		if err != nil {
 			log.Fatalf("failed to get runtime statistics: %+v", err)
 		}
+		if r != nil {
+			if len(sessionIDs) == 0 {
+				sessionIDs = append(sessionIDs, r.Session().ID)
+			}
+			if !*plotChart {
+				// plotting prints the summary as well
+				printSummary(r.Session(), *throttlingThreshold)
+			}
+		}
 	}
 
 	fmt.Println("plot:", *plotChart)
 	if *plotChart {
-		list, err := c.List()
+		list, err := listSessions(sessionIDs, persistence.ListOptions{
+			From:       from.Time,
+			To:         to.Time,
+			Containers: containerNames,
+			Resolution: resolution.Resolution,
+			Aggregate:  aggregate.Aggregate,
+		})
 		if err != nil {
 			log.Fatalf("failed to list datapoints: %v", err)
 		}
 
-		for id, d := range list {
-			fmt.Println("---")
-			fmt.Printf("id:           %06d\n", id)
-			fmt.Printf("timestamp:    %s\n", d.Timestamp.Format(time.RFC3339))
-			fmt.Printf("memory usage: %s\n", d.MemoryUsageStr())
-			fmt.Printf("memory limit: %s\n", d.MemoryLimitStr())
-			fmt.Printf("cpu percent:  %01.2f\n", d.CPUPercentage)
-			fmt.Printf("cpu online:   %01.2f\n", d.CPUOnlineCount)
-			fmt.Printf("cpu usage:    %01.2f\n", d.CPUUsage)
-			fmt.Printf("timestamp:    %v\n", d.Timestamp)
-			fmt.Println("")
+		for _, cs := range list {
+			fmt.Println("===")
+			fmt.Printf("container:    %s (%s)\n", cs.Name, cs.ShortID())
+			if cs.Resolution != "" {
+				fmt.Printf("resolution:   %s (%s)\n", cs.Resolution, cs.Aggregate)
+			}
+			if cs.Exit != nil {
+				fmt.Printf("exit code:    %d\n", cs.Exit.Code)
+				fmt.Printf("oom killed:   %v\n", cs.Exit.OOMKilled)
+			}
+			for id, d := range cs.Datapoints {
+				fmt.Println("---")
+				fmt.Printf("id:           %06d\n", id)
+				fmt.Printf("timestamp:    %s\n", d.Timestamp.Format(time.RFC3339))
+				fmt.Printf("memory usage: %s\n", d.MemoryUsageStr())
+				fmt.Printf("memory limit: %s\n", d.MemoryLimitStr())
+				fmt.Printf("working set:  %s\n", d.MemoryWorkingSetStr())
+				fmt.Printf("cpu percent:  %01.2f\n", d.CPUPercentage)
+				fmt.Printf("cpu user:     %01.2f\n", d.CPUUserPercentage)
+				fmt.Printf("cpu kernel:   %01.2f\n", d.CPUKernelPercentage)
+				fmt.Printf("cpu online:   %01.2f\n", d.CPUOnlineCount)
+				fmt.Printf("cpu usage:    %01.2f\n", d.CPUUsage)
+				fmt.Printf("pids:         %.0f/%.0f\n", d.PidsCurrent, d.PidsLimit)
+				for name, n := range d.Networks {
+					fmt.Printf("net %s rx:   %s (%s/s)\n", name, helper.FormatMemory(uint64(n.RxBytes)), helper.FormatMemory(uint64(n.RxBytesRate)))
+					fmt.Printf("net %s tx:   %s (%s/s)\n", name, helper.FormatMemory(uint64(n.TxBytes)), helper.FormatMemory(uint64(n.TxBytesRate)))
+				}
+				for device, b := range d.BlockIO {
+					fmt.Printf("disk %s read:  %s (%s/s, %01.2f iops)\n", device, helper.FormatMemory(uint64(b.ReadBytes)), helper.FormatMemory(uint64(b.ReadBytesRate)), b.ReadIOPS)
+					fmt.Printf("disk %s write: %s (%s/s, %01.2f iops)\n", device, helper.FormatMemory(uint64(b.WriteBytes)), helper.FormatMemory(uint64(b.WriteBytesRate)), b.WriteIOPS)
+				}
+				if len(d.Missing) > 0 {
+					fmt.Printf("missing:      %s\n", strings.Join(d.Missing, ", "))
+				}
+				fmt.Printf("timestamp:    %v\n", d.Timestamp)
+				fmt.Println("")
+			}
+		}
+
+		dir, err := chartsDir(*outDir)
+		if err != nil {
+			log.Fatalf("failed to locate charts directory: %v", err)
+		}
+		plotErr := plot.Plot(dir, list)
+		fmt.Println("charts:", dir)
+
+		opts := report.Options{ThrottlingThreshold: *throttlingThreshold}
+		report.Print(os.Stdout, report.Summarize(list, opts), opts)
+		if plotErr != nil {
+			log.Fatalf("failed to plot charts: %v", plotErr)
+		}
+
+	}
+}
+
+// registerDataDirFlag adds the -data-dir flag, relocating the sessions.
+func registerDataDirFlag(fs *flag.FlagSet) {
+	fs.Func("data-dir", "Directory holding the sessions (defaults to $"+persistence.DataDirEnv+", or docker-profiler under the XDG data home)", func(dir string) error {
+		persistence.SetDataDir(dir)
+		return nil
+	})
+}
+
+// chartsDir returns the directory the charts are written to: dir when
+// set, else $DOCKER_PROFILER_OUT_DIR, else charts under the data
+// directory.
+func chartsDir(dir string) (string, error) {
+	if dir != "" {
+		return dir, nil
+	}
+	if dir := os.Getenv(outDirEnv); dir != "" {
+		return dir, nil
+	}
+	dataDir, err := persistence.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, "charts"), nil
+}
+
+// profilingContext is cancelled on SIGINT/SIGTERM or, when set, once the
+// duration has elapsed. The signals get their default behaviour back once
+// it's cancelled, so a second one kills a shutdown taking too long.
+func profilingContext(duration time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	cancel := context.CancelFunc(func() {})
+	if duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, duration)
+	}
+	context.AfterFunc(ctx, stop)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// printSummary prints the report summary of the session.
+func printSummary(s model.Session, throttlingThreshold float64) {
+	list, err := listSessions([]string{s.ID}, summaryListOptions(s))
+	if err != nil {
+		log.Printf("failed to summarize session '%s': %v", s.ID, err)
+		return
+	}
+	opts := report.Options{ThrottlingThreshold: throttlingThreshold}
+	report.Print(os.Stdout, report.Summarize(list, opts), opts)
+}
+
+// summaryListOptions lists the datapoints the summary of the session is
+// built from: the raw ones, unless some got pruned, in which case the
+// rollups keep the maxima.
+func summaryListOptions(s model.Session) persistence.ListOptions {
+	if s.PrunedUntil != nil {
+		return persistence.ListOptions{Aggregate: persistence.Max}
+	}
+	return persistence.ListOptions{Resolution: persistence.Raw}
+}
+
+// listSessions returns the series of the sessions, or of the latest
+// session when none is given.
+func listSessions(ids []string, opts persistence.ListOptions) ([]model.ContainerSeries, error) {
+	if len(ids) == 0 {
+		sessions, err := persistence.ListSessions()
+		if err != nil {
+			return nil, err
+		}
+		if len(sessions) == 0 {
+			return nil, errors.New("no sessions recorded")
+		}
+		ids = []string{sessions[len(sessions)-1].ID}
+	}
+
+	var list []model.ContainerSeries
+	for _, id := range ids {
+		r, err := persistence.NewRepository(id)
+		if err != nil {
+			return nil, err
+		}
+		l, err := r.List(opts)
+		_ = r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing session '%s': %w", id, err)
 		}
+		list = append(list, l...)
+	}
+	return list, nil
+}
+
+// stringList is a flag value that can be repeated and also accepts
+// comma separated values.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// storageValue is a flag value naming a storage backend.
+type storageValue struct {
+	persistence.StorageKind
+}
+
+func (s *storageValue) String() string {
+	if s == nil {
+		return ""
+	}
+	return string(s.StorageKind)
+}
+
+func (s *storageValue) Set(value string) error {
+	kind, err := persistence.ParseStorage(value)
+	if err != nil {
+		return err
+	}
+	s.StorageKind = kind
+	return nil
+}
 
-		//plot.PlotToFile(list)
-		plot.Plot(list)
+// resolutionValue is a flag value naming a datapoints resolution.
+type resolutionValue struct {
+	persistence.Resolution
+}
 
+func (r *resolutionValue) String() string {
+	if r == nil {
+		return ""
+	}
+	return string(r.Resolution)
+}
+
+func (r *resolutionValue) Set(value string) error {
+	res, err := persistence.ParseResolution(value)
+	if err != nil {
+		return err
+	}
+	r.Resolution = res
+	return nil
+}
+
+// aggregateValue is a flag value naming the aggregate of downsampled
+// datapoints.
+type aggregateValue struct {
+	persistence.Aggregate
+}
+
+func (a *aggregateValue) String() string {
+	if a == nil {
+		return ""
+	}
+	return string(a.Aggregate)
+}
+
+func (a *aggregateValue) Set(value string) error {
+	agg, err := persistence.ParseAggregate(value)
+	if err != nil {
+		return err
+	}
+	a.Aggregate = agg
+	return nil
+}
+
+// timeValue is a flag value accepting a RFC3339 time or a duration
+// relative to now (eg: -15m).
+type timeValue struct {
+	time.Time
+}
+
+func (t *timeValue) String() string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (t *timeValue) Set(value string) error {
+	if d, err := time.ParseDuration(value); err == nil {
+		t.Time = time.Now().Add(d)
+		return nil
+	}
+	v, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("expected a RFC3339 time or a duration: %w", err)
 	}
+	t.Time = v
+	return nil
 }
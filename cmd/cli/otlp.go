@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/eldius/docker-profiler/internal/docker"
+	"github.com/eldius/docker-profiler/internal/otlpexport"
+	"log"
+	"time"
+)
+
+// otlpFlags configures exporting the collected stats over OTLP.
+type otlpFlags struct {
+	endpoint *string
+	protocol *string
+	insecure *bool
+	interval *time.Duration
+}
+
+func registerOTLPFlags(fs *flag.FlagSet) otlpFlags {
+	return otlpFlags{
+		endpoint: fs.String("otlp", "", "Export the metrics to the OpenTelemetry collector (`host:port` or URL)"),
+		protocol: fs.String("otlp-protocol", string(otlpexport.GRPC), "OTLP protocol (grpc or http)"),
+		insecure: fs.Bool("otlp-insecure", false, "Connect to the OpenTelemetry collector without TLS"),
+		interval: fs.Duration("otlp-interval", 0, "OTLP export interval (defaults to 10s)"),
+	}
+}
+
+// exporter connects to the collector, or returns nil when exporting
+// wasn't asked for.
+func (f otlpFlags) exporter(ctx context.Context) *otlpexport.Exporter {
+	if *f.endpoint == "" {
+		return nil
+	}
+	protocol, err := otlpexport.ParseProtocol(*f.protocol)
+	if err != nil {
+		log.Fatalf("invalid OTLP protocol: %v", err)
+	}
+	e, err := otlpexport.New(ctx, otlpexport.Options{
+		Protocol: protocol,
+		Endpoint: *f.endpoint,
+		Insecure: *f.insecure,
+		Interval: *f.interval,
+	})
+	if err != nil {
+		log.Fatalf("failed to create OTLP exporter: %v", err)
+	}
+	return e
+}
+
+// sinks returns the exporter as profiling sinks.
+func sinks(e *otlpexport.Exporter) []docker.Sink {
+	if e == nil {
+		return nil
+	}
+	return []docker.Sink{e}
+}
+
+// closeExporter flushes the samples not exported yet.
+func closeExporter(e *otlpexport.Exporter) {
+	if e == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Close(ctx); err != nil {
+		log.Printf("failed to flush OTLP metrics: %v", err)
+	}
+}
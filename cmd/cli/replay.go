@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/eldius/docker-profiler/internal/docker"
+	"github.com/eldius/docker-profiler/internal/persistence"
+	"io"
+	"log"
+	"os"
+)
+
+// replayCmd feeds a raw stats recording through the profiling pipeline
+// into a new session.
+func replayCmd(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] FILE\n\nFILE is a recording made with -record, use - for stdin.\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	speed := fs.Float64("speed", 1, "Replay speed factor (1 is real time, 0 replays without pausing)")
+	note := fs.String("note", "", "Free-form note about the session")
+	storage := storageValue{persistence.TStorage}
+	fs.Var(&storage, "storage", "Storage backend of the session datapoints (tstorage or sqlite)")
+	retention := fs.Duration("retention", 0, "How long the raw datapoints are kept once downsampled into 1m/5m rollups, back from the latest datapoint rather than from now (0 keeps them, at least 15m, sqlite storage only)")
+	registerDataDirFlag(fs)
+	throttlingThreshold := fs.Float64("throttling-threshold", defaultThrottlingThreshold, "Throttled periods percentage above which the summary flags a session")
+
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var in io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("failed to open recording: %v", err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		in = f
+	}
+
+	r, err := persistence.NewSession(persistence.SessionOptions{
+		Args:      os.Args[1:],
+		Note:      *note,
+		Storage:   storage.StorageKind,
+		Retention: *retention,
+	})
+	if err != nil {
+		log.Fatalf("failed to create session: %v", err)
+	}
+	fmt.Println("session:", r.Session().ID)
+
+	ctx, cancel := profilingContext(0)
+	defer cancel()
+
+	if err := docker.Replay(ctx, r, in, *speed); err != nil {
+		log.Fatalf("failed to replay recording: %v", err)
+	}
+
+	printSummary(r.Session(), *throttlingThreshold)
+}
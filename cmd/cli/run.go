@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/eldius/docker-profiler/internal/docker"
+	"github.com/eldius/docker-profiler/internal/persistence"
+	"log"
+	"os"
+)
+
+// runCmd creates a container and profiles it until it exits.
+func runCmd(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s run [flags] IMAGE [COMMAND [ARG...]]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	name := fs.String("name", "", "Container name")
+	memory := fs.String("m", "", "Memory limit (eg: 512m)")
+	cpus := fs.Float64("cpus", 0, "Number of CPUs")
+	var env stringList
+	fs.Var(&env, "e", "Environment variable (`KEY=value`, can be repeated)")
+	remove := fs.Bool("rm", false, "Remove the container when it exits")
+	interval := fs.Duration("interval", 0, "Sampling interval, polling one-shot stats instead of the daemon stats stream (~1s)")
+	record := fs.String("record", "", "Save every raw stats document received to the file, as newline-delimited JSON")
+	duration := fs.Duration("duration", 0, "Stop the container after the given duration (0 means no limit)")
+	note := fs.String("note", "", "Free-form note about the profiling session")
+	persist := fs.Bool("persist", true, "Record the stats in a profiling session (disable it to only export them with -otlp)")
+	storage := storageValue{persistence.TStorage}
+	fs.Var(&storage, "storage", "Storage backend of the session datapoints (tstorage or sqlite)")
+	retention := fs.Duration("retention", 0, "How long the raw datapoints are kept once downsampled into 1m/5m rollups, back from the latest datapoint rather than from now (0 keeps them, at least 15m, sqlite storage only)")
+	otlp := registerOTLPFlags(fs)
+	registerDataDirFlag(fs)
+
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	opts := docker.RunOptions{
+		Image:    fs.Arg(0),
+		Cmd:      fs.Args()[1:],
+		Env:      env,
+		Name:     *name,
+		NanoCPUs: int64(*cpus * 1e9),
+		Remove:   *remove,
+		Interval: *interval,
+	}
+	if *record != "" {
+		f, err := os.Create(*record)
+		if err != nil {
+			log.Fatalf("failed to create record file: %v", err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		opts.Record = f
+	}
+	if *memory != "" {
+		m, err := units.RAMInBytes(*memory)
+		if err != nil {
+			log.Fatalf("invalid memory limit: %v", err)
+		}
+		opts.Memory = m
+	}
+
+	var r *persistence.Repository
+	if *persist {
+		var err error
+		r, err = persistence.NewSession(persistence.SessionOptions{
+			Args:      os.Args[1:],
+			Note:      *note,
+			Interval:  *interval,
+			Storage:   storage.StorageKind,
+			Retention: *retention,
+		})
+		if err != nil {
+			log.Fatalf("failed to create session: %v", err)
+		}
+		fmt.Println("session:", r.Session().ID)
+	}
+
+	c, err := docker.NewClient(r)
+	if err != nil {
+		log.Fatalf("failed to create client: %v", err)
+	}
+
+	ctx, cancel := profilingContext(*duration)
+	defer cancel()
+
+	exporter := otlp.exporter(ctx)
+	opts.Sinks = sinks(exporter)
+
+	exit, err := c.Run(ctx, opts)
+	closeExporter(exporter)
+	if err != nil {
+		log.Fatalf("failed to run container: %+v", err)
+	}
+
+	fmt.Println("---")
+	fmt.Printf("exit code:    %d\n", exit.Code)
+	fmt.Printf("oom killed:   %v\n", exit.OOMKilled)
+
+	if r != nil {
+		printSummary(r.Session(), defaultThrottlingThreshold)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/eldius/docker-profiler/internal/docker"
+	"github.com/eldius/docker-profiler/internal/persistence"
+	"github.com/eldius/docker-profiler/internal/promexport"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	defaultListenAddr = ":9337"
+)
+
+// serveCmd profiles the matching containers, including the ones started
+// later, exposing their live metrics to Prometheus until interrupted.
+func serveCmd(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s serve [flags]\n\nProfiles the selected containers (every container when no selection is given) exposing their metrics at /metrics.\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	listen := fs.String("listen", defaultListenAddr, "Address to serve the metrics on")
+	var containerNames stringList
+	fs.Var(&containerNames, "container", "Container name to be profiled (repeat it or use a comma separated list for more than one)")
+	var labels stringList
+	fs.Var(&labels, "label", "Profile containers with the label (`key` or `key=value`, can be repeated)")
+	image := fs.String("image", "", "Profile containers created from the image")
+	composeProject := fs.String("compose-project", "", "Profile containers of the docker compose project")
+	composeService := fs.String("compose-service", "", "Profile containers of the docker compose service")
+	interval := fs.Duration("interval", 0, "Sampling interval, polling one-shot stats instead of the daemon stats stream (~1s)")
+	persist := fs.Bool("persist", false, "Also record the stats in a profiling session")
+	note := fs.String("note", "", "Free-form note about the profiling session (with -persist)")
+	storage := storageValue{persistence.TStorage}
+	fs.Var(&storage, "storage", "Storage backend of the session datapoints (tstorage or sqlite) (with -persist)")
+	retention := fs.Duration("retention", 0, "How long the raw datapoints are kept once downsampled into 1m/5m rollups, back from the latest datapoint rather than from now (0 keeps them, at least 15m, sqlite storage only) (with -persist)")
+	otlp := registerOTLPFlags(fs)
+	registerDataDirFlag(fs)
+
+	_ = fs.Parse(args)
+
+	sel := docker.Selector{
+		Names:          containerNames,
+		Labels:         labels,
+		Image:          *image,
+		ComposeProject: *composeProject,
+		ComposeService: *composeService,
+	}
+
+	var r *persistence.Repository
+	if *persist {
+		var err error
+		r, err = persistence.NewSession(persistence.SessionOptions{
+			Args:      os.Args[1:],
+			Note:      *note,
+			Interval:  *interval,
+			Storage:   storage.StorageKind,
+			Retention: *retention,
+		})
+		if err != nil {
+			log.Fatalf("failed to create session: %v", err)
+		}
+		fmt.Println("session:", r.Session().ID)
+	}
+
+	c, err := docker.NewClient(r)
+	if err != nil {
+		log.Fatalf("failed to create client: %v", err)
+	}
+
+	exporter := promexport.New()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter.Handler())
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("failed to serve metrics: %v", err)
+		}
+	}()
+	fmt.Printf("serving metrics on %s/metrics\n", *listen)
+
+	ctx, cancel := profilingContext(0)
+	defer cancel()
+
+	otlpExporter := otlp.exporter(ctx)
+	opts := docker.ProfileOptions{
+		Follow:   true,
+		Interval: *interval,
+		Sinks:    append([]docker.Sink{exporter}, sinks(otlpExporter)...),
+	}
+	err = c.GetRuntimeStatistcs(ctx, sel, opts)
+	closeExporter(otlpExporter)
+	if err != nil {
+		log.Fatalf("failed to get runtime statistics: %+v", err)
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to stop serving metrics: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/eldius/docker-profiler/internal/helper"
+	"github.com/eldius/docker-profiler/internal/model"
+	"github.com/eldius/docker-profiler/internal/persistence"
+	"github.com/eldius/docker-profiler/internal/report"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// sessionsCmd lists, shows and deletes profiling sessions.
+func sessionsCmd(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s sessions list|show [-throttling-threshold PERCENT] SESSION_ID|downsample SESSION_ID...|delete SESSION_ID... (all taking -data-dir DIR)\n", os.Args[0])
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+
+	fs := flag.NewFlagSet("sessions "+args[0], flag.ExitOnError)
+	registerDataDirFlag(fs)
+
+	switch args[0] {
+	case "list":
+		_ = fs.Parse(args[1:])
+		sessions, err := persistence.ListSessions()
+		if err != nil {
+			log.Fatalf("failed to list sessions: %v", err)
+		}
+		for _, s := range sessions {
+			var names []string
+			for _, c := range s.Containers {
+				names = append(names, c.Name)
+			}
+			fmt.Printf("%s  %s  %-10s  %s  %s\n", s.ID, s.StartedAt.Format(time.RFC3339), sessionDuration(s), strings.Join(names, ","), s.Note)
+		}
+	case "show":
+		throttlingThreshold := fs.Float64("throttling-threshold", defaultThrottlingThreshold, "Throttled periods percentage above which the summary flags a session")
+		_ = fs.Parse(args[1:])
+		if fs.NArg() < 1 {
+			usage()
+		}
+		s, err := persistence.LoadSession(fs.Arg(0))
+		if err != nil {
+			log.Fatalf("failed to load session: %v", err)
+		}
+		printSession(s)
+
+		list, err := listSessions([]string{s.ID}, summaryListOptions(s))
+		if err != nil {
+			log.Fatalf("failed to list datapoints: %v", err)
+		}
+		opts := report.Options{ThrottlingThreshold: *throttlingThreshold}
+		fmt.Println()
+		report.Print(os.Stdout, report.Summarize(list, opts), opts)
+	case "downsample":
+		_ = fs.Parse(args[1:])
+		if fs.NArg() < 1 {
+			usage()
+		}
+		for _, id := range fs.Args() {
+			if err := downsampleSession(id); err != nil {
+				log.Fatalf("failed to downsample session: %v", err)
+			}
+			fmt.Println("downsampled:", id)
+		}
+	case "delete":
+		_ = fs.Parse(args[1:])
+		if fs.NArg() < 1 {
+			usage()
+		}
+		for _, id := range fs.Args() {
+			if err := persistence.DeleteSession(id); err != nil {
+				log.Fatalf("failed to delete session: %v", err)
+			}
+			fmt.Println("deleted:", id)
+		}
+	default:
+		usage()
+	}
+}
+
+func printSession(s model.Session) {
+	fmt.Printf("id:           %s\n", s.ID)
+	fmt.Printf("started at:   %s\n", s.StartedAt.Format(time.RFC3339))
+	if s.EndedAt != nil {
+		fmt.Printf("ended at:     %s\n", s.EndedAt.Format(time.RFC3339))
+	}
+	fmt.Printf("duration:     %s\n", sessionDuration(s))
+	if s.Interval > 0 {
+		fmt.Printf("interval:     %s\n", s.Interval)
+	}
+	if s.Storage != "" {
+		fmt.Printf("storage:      %s\n", s.Storage)
+	}
+	if s.Retention > 0 {
+		fmt.Printf("retention:    %s\n", s.Retention)
+	}
+	if s.DownsampledUntil != nil {
+		fmt.Printf("downsampled:  %s\n", s.DownsampledUntil.Format(time.RFC3339))
+	}
+	if s.PrunedUntil != nil {
+		fmt.Printf("pruned:       %s\n", s.PrunedUntil.Format(time.RFC3339))
+	}
+	fmt.Printf("args:         %s\n", strings.Join(s.Args, " "))
+	fmt.Printf("note:         %s\n", s.Note)
+	for _, c := range s.Containers {
+		fmt.Println("---")
+		fmt.Printf("container:    %s (%s)\n", c.Name, c.ShortID())
+		if !c.StartedAt.IsZero() {
+			fmt.Printf("started at:   %s\n", c.StartedAt.Format(time.RFC3339))
+		}
+		fmt.Printf("image:        %s\n", c.Image)
+		fmt.Printf("image digest: %s\n", c.ImageDigest)
+		if c.Limits.Memory > 0 {
+			fmt.Printf("memory limit: %s\n", helper.FormatMemory(uint64(c.Limits.Memory)))
+		}
+		if cpus := c.Limits.CPUs(); cpus > 0 {
+			fmt.Printf("cpu limit:    %01.2f\n", cpus)
+		}
+		if c.Limits.CpusetCpus != "" {
+			fmt.Printf("cpuset:       %s\n", c.Limits.CpusetCpus)
+		}
+		if c.Limits.PidsLimit > 0 {
+			fmt.Printf("pids limit:   %d\n", c.Limits.PidsLimit)
+		}
+		if c.Exit != nil {
+			fmt.Printf("exit code:    %d\n", c.Exit.Code)
+			fmt.Printf("oom killed:   %v\n", c.Exit.OOMKilled)
+		}
+	}
+}
+
+// downsampleSession rolls up the datapoints of the session, all of them
+// once it has ended.
+func downsampleSession(id string) error {
+	r, err := persistence.NewRepository(id)
+	if err != nil {
+		return err
+	}
+	err = r.Downsample(r.Session().EndedAt != nil)
+	return errors.Join(err, r.Close())
+}
+
+func sessionDuration(s model.Session) string {
+	if s.EndedAt == nil {
+		return "-"
+	}
+	return s.EndedAt.Sub(s.StartedAt).Round(time.Second).String()
+}
@@ -0,0 +1,418 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types/events"
+	"github.com/eldius/docker-profiler/internal/model"
+	"io"
+	"sync"
+	"time"
+)
+
+// collector keeps one stats stream per profiled container lifecycle.
+type collector struct {
+	c   Client
+	sel Selector
+	// interval switches from the daemon stats stream to one-shot polling
+	// at the given rate, when set.
+	interval time.Duration
+	// rec saves the raw stats documents, when set.
+	rec *recorder
+	// sinks receive every sample, next to the session repository.
+	sinks []Sink
+
+	mu      sync.Mutex
+	streams map[string]*stream
+	// seen counts the lifecycles attached so far
+	seen int
+	// released is signalled whenever a stream finishes
+	released chan struct{}
+	wg       sync.WaitGroup
+}
+
+// stream is the stats stream (or poller) of a running container.
+type stream struct {
+	container model.SessionContainer
+	stop      func()
+}
+
+// recorder writes raw stats documents as newline-delimited JSON.
+type recorder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// record writes the document of the container, tagged with the container
+// start time so replays keep the container lifecycles apart. Invalid
+// documents are written as is.
+func (rec *recorder) record(doc []byte, c model.Container) {
+	if rec == nil {
+		return
+	}
+	doc = bytes.TrimSpace(doc)
+	if !c.StartedAt.IsZero() && json.Valid(doc) && bytes.HasPrefix(doc, []byte("{")) {
+		tag := fmt.Sprintf(`{"started_at":%q`, c.StartedAt.UTC().Format(time.RFC3339Nano))
+		if rest := bytes.TrimSpace(doc[1:]); !bytes.HasPrefix(rest, []byte("}")) {
+			tag += ","
+		}
+		doc = append([]byte(tag), doc[1:]...)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if _, err := fmt.Fprintf(rec.w, "%s\n", doc); err != nil {
+		fmt.Printf("failed to record stats: %v\n", err)
+	}
+}
+
+func newCollector(c Client, sel Selector, opts ProfileOptions) *collector {
+	var rec *recorder
+	if opts.Record != nil {
+		rec = &recorder{w: opts.Record}
+	}
+	return &collector{
+		c:        c,
+		sel:      sel,
+		interval: opts.Interval,
+		rec:      rec,
+		sinks:    opts.Sinks,
+		streams:  make(map[string]*stream),
+		released: make(chan struct{}, 1),
+	}
+}
+
+// attach starts streaming the stats of the container, unless it's already
+// being profiled.
+func (col *collector) attach(ctx context.Context, id string) error {
+	info, err := col.c.d.ContainerInspect(ctx, id)
+	if err != nil {
+		return fmt.Errorf("inspecting container '%s': %w", id, err)
+	}
+	if info.State == nil || !info.State.Running {
+		return nil
+	}
+	startedAt, _ := time.Parse(time.RFC3339Nano, info.State.StartedAt)
+	mc := model.Container{
+		ID:        info.ID,
+		Name:      normalizeName(info.Name),
+		StartedAt: startedAt,
+	}
+	if col.attached(mc.ID) {
+		return nil
+	}
+	sc, err := col.c.register(ctx, mc, info)
+	if err != nil {
+		return err
+	}
+	return col.open(ctx, sc)
+}
+
+func (col *collector) attached(id string) bool {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+
+	_, ok := col.streams[id]
+	return ok
+}
+
+// open starts streaming the stats of the container lifecycle.
+func (col *collector) open(ctx context.Context, mc model.SessionContainer) error {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+
+	if _, ok := col.streams[mc.ID]; ok {
+		return nil
+	}
+
+	fmt.Printf("- %v\n\n", mc.Name)
+	if col.interval > 0 {
+		pollCtx, cancel := context.WithCancel(ctx)
+		st := &stream{
+			container: mc,
+			stop:      cancel,
+		}
+		col.streams[mc.ID] = st
+		col.seen++
+
+		col.wg.Add(1)
+		go col.poll(pollCtx, st)
+		return nil
+	}
+
+	s, err := col.c.d.ContainerStats(ctx, mc.ID, true)
+	if err != nil {
+		err = fmt.Errorf("fetching container status for '%s': %w", mc.Name, err)
+		return err
+	}
+	st := &stream{
+		container: mc,
+		stop: func() {
+			_ = s.Body.Close()
+		},
+	}
+	col.streams[mc.ID] = st
+	col.seen++
+
+	col.wg.Add(1)
+	go col.consume(st, s.Body)
+
+	return nil
+}
+
+// detach closes the stats stream of the container, if any.
+func (col *collector) detach(id string) {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+
+	if st, ok := col.streams[id]; ok {
+		st.stop()
+		delete(col.streams, id)
+		col.forget(st)
+		col.signal()
+	}
+}
+
+func (col *collector) consume(st *stream, body io.Reader) {
+	defer col.wg.Done()
+	defer col.release(st)
+
+	dec := model.NewStatsDecoder(body)
+	for {
+		var stats model.ContainerStats
+		err := dec.Decode(&stats)
+		if errors.Is(err, model.ErrInvalidStats) {
+			col.rec.record(dec.Bytes(), st.container.Container)
+			fmt.Printf("skipping stats of '%s': %v\n", st.container.Name, err)
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !col.stopped(st) {
+				fmt.Printf("failed to read stats of '%s': %v\n", st.container.Name, err)
+			}
+			return
+		}
+		col.rec.record(dec.Bytes(), st.container.Container)
+		col.handle(st, stats)
+	}
+}
+
+// stopped tells whether the stream was closed by the collector, rather
+// than ended by the daemon.
+func (col *collector) stopped(st *stream) bool {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+
+	return col.streams[st.container.ID] != st
+}
+
+// poll fetches one-shot stats at the collector interval until the
+// container stops or the poller is stopped. The previous sample fills
+// the "pre" fields, which one-shot stats leave empty.
+func (col *collector) poll(ctx context.Context, st *stream) {
+	defer col.wg.Done()
+	defer col.release(st)
+
+	ticker := time.NewTicker(col.interval)
+	defer ticker.Stop()
+
+	var prev *model.ContainerStats
+	for {
+		stats, err := col.fetch(ctx, st.container.Container)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Printf("failed to fetch stats of '%s': %v\n", st.container.Name, err)
+			}
+			return
+		}
+		if stats.Read.IsZero() {
+			// not running anymore
+			return
+		}
+		fillPre(&stats, prev)
+		col.handle(st, stats)
+		prev = &stats
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (col *collector) fetch(ctx context.Context, c model.Container) (model.ContainerStats, error) {
+	var stats model.ContainerStats
+	s, err := col.c.d.ContainerStatsOneShot(ctx, c.ID)
+	if err != nil {
+		return stats, err
+	}
+	defer func() {
+		_ = s.Body.Close()
+	}()
+	doc, err := io.ReadAll(s.Body)
+	if err != nil {
+		return stats, fmt.Errorf("reading stats: %w", err)
+	}
+	col.rec.record(doc, c)
+	if err := json.Unmarshal(doc, &stats); err != nil {
+		return stats, fmt.Errorf("decoding stats: %w", err)
+	}
+	return stats, nil
+}
+
+// fillPre fills the "pre" fields one-shot stats leave empty with the
+// previous sample, if any.
+func fillPre(stats *model.ContainerStats, prev *model.ContainerStats) {
+	if prev == nil || !stats.PreRead.IsZero() {
+		return
+	}
+	stats.PreRead = prev.Read
+	stats.PreCPUStats = prev.CPUStats
+}
+
+// handle persists, exports and prints a stats sample.
+func (col *collector) handle(st *stream, stats model.ContainerStats) {
+	stats.StartedAt = st.container.StartedAt
+	if col.c.r != nil {
+		if err := col.c.r.Persist(stats); err != nil {
+			err = fmt.Errorf("persisting container stats: %w", err)
+			panic(err)
+		}
+	}
+	for _, sink := range col.sinks {
+		if err := sink.Observe(st.container, stats); err != nil {
+			fmt.Printf("failed to export stats of '%s': %v\n", st.container.Name, err)
+		}
+	}
+	fmt.Printf("---\n- container: %s\n- cpu:\n  - total usage: %v\n  - percent usage: %01.2f%%\n  - online: %v\n", st.container.Name, stats.CPUStats.CPUUsage.TotalUsage, stats.CPUUsagePercentage(), stats.CPUStats.OnlineCPUs)
+	fmt.Printf("\n- memory:\n  - limit: %s\n  - usage: %s\n  - working set: %s\n", stats.MemoryLimitStr(), stats.MemoryUsageStr(), stats.MemoryWorkingSetStr())
+	fmt.Printf("\n- pids:\n  - current: %d\n  - limit: %d\n", stats.PidsStats.Current, stats.PidsStats.Limit)
+}
+
+// release forgets the stream once it's finished, so a new lifecycle of
+// the same container can be attached.
+func (col *collector) release(st *stream) {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+
+	st.stop()
+	if col.streams[st.container.ID] == st {
+		delete(col.streams, st.container.ID)
+		col.forget(st)
+		col.signal()
+	}
+}
+
+// forget tells the sinks the stream is finished.
+func (col *collector) forget(st *stream) {
+	for _, sink := range col.sinks {
+		sink.Forget(st.container.Container)
+	}
+}
+
+// signal wakes up whoever waits for streams to finish, without blocking.
+func (col *collector) signal() {
+	select {
+	case col.released <- struct{}{}:
+	default:
+	}
+}
+
+// exited tells whether every attached container lifecycle has finished.
+func (col *collector) exited() bool {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+
+	return col.seen > 0 && len(col.streams) == 0
+}
+
+// follow attaches to the containers started and detaches from the ones
+// stopped until the context is done or, with untilExit, every profiled
+// container has exited.
+func (col *collector) follow(ctx context.Context, evs <-chan events.Message, errs <-chan error, untilExit bool) error {
+	streamCtx := context.WithoutCancel(ctx)
+	for {
+		select {
+		case <-col.released:
+			if untilExit && col.exited() {
+				return nil
+			}
+		case ev := <-evs:
+			switch ev.Action {
+			case events.ActionStart:
+				if name := ev.Actor.Attributes["name"]; len(col.sel.Names) > 0 && !col.sel.matchesName(name) {
+					continue
+				}
+				if ok, err := col.selected(streamCtx, ev.Actor.ID); err != nil || !ok {
+					if err != nil {
+						fmt.Printf("failed to check container '%s': %v\n", ev.Actor.ID, err)
+					}
+					continue
+				}
+				if err := col.attach(streamCtx, ev.Actor.ID); err != nil {
+					fmt.Printf("failed to attach to container '%s': %v\n", ev.Actor.ID, err)
+				}
+			case events.ActionDie, events.ActionDestroy:
+				col.detach(ev.Actor.ID)
+			}
+		case err := <-errs:
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return nil
+			}
+			return fmt.Errorf("watching container events: %w", err)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// selected tells whether the started container matches the image
+// selection, the same way as the containers listed at startup.
+func (col *collector) selected(ctx context.Context, id string) (bool, error) {
+	if col.sel.Image == "" {
+		return true, nil
+	}
+	list, err := col.c.d.ContainerList(ctx, col.sel.ContainerListOptions(id))
+	if err != nil {
+		return false, fmt.Errorf("listing container: %w", err)
+	}
+	return len(list) > 0, nil
+}
+
+func (col *collector) wait() {
+	col.wg.Wait()
+}
+
+// drain waits for the streams to finish, closing them once the context is
+// done. Samples already read still get persisted before it returns.
+func (col *collector) drain(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		col.wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		col.closeAll()
+		<-done
+	}
+}
+
+// closeAll closes every open stats stream.
+func (col *collector) closeAll() {
+	col.mu.Lock()
+	defer col.mu.Unlock()
+
+	for id, st := range col.streams {
+		st.stop()
+		delete(col.streams, id)
+		col.forget(st)
+	}
+}
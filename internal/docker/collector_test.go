@@ -0,0 +1,266 @@
+package docker_test
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/eldius/docker-profiler/internal/docker"
+	"github.com/eldius/docker-profiler/internal/docker/dockertest"
+	"github.com/eldius/docker-profiler/internal/model"
+	"github.com/eldius/docker-profiler/internal/persistence"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+const statsInterval = 10 * time.Millisecond
+
+// scriptedStats returns n cumulative stats documents read a second apart,
+// using 30% of one CPU. The "pre" fields are left empty, as one-shot stats
+// do, and the system usage starts at an offset, so samples missing them
+// are off.
+func scriptedStats(n int) []types.StatsJSON {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	docs := make([]types.StatsJSON, n)
+	for i := range docs {
+		docs[i].Read = start.Add(time.Duration(i) * time.Second)
+		docs[i].MemoryStats.Usage = uint64(1000 * (i + 1))
+		docs[i].MemoryStats.Limit = 1 << 20
+		docs[i].CPUStats.OnlineCPUs = 1
+		docs[i].CPUStats.SystemUsage = uint64(5000 + 1000*(i+1))
+		docs[i].CPUStats.CPUUsage.TotalUsage = uint64(300 * (i + 1))
+	}
+	return docs
+}
+
+// withPre fills the "pre" fields of the documents, as streamed stats do.
+func withPre(docs []types.StatsJSON) []types.StatsJSON {
+	for i := 1; i < len(docs); i++ {
+		docs[i].PreRead = docs[i-1].Read
+		docs[i].PreCPUStats = docs[i-1].CPUStats
+	}
+	return docs
+}
+
+// recordingSink records the containers observed and forgotten.
+type recordingSink struct {
+	mu        sync.Mutex
+	observed  map[string]int
+	forgotten []string
+	// onObserve is called on the first sample observed, when set.
+	onObserve func()
+	once      sync.Once
+}
+
+func (s *recordingSink) Observe(sc model.SessionContainer, _ model.ContainerStats) error {
+	s.mu.Lock()
+	if s.observed == nil {
+		s.observed = make(map[string]int)
+	}
+	s.observed[sc.Name]++
+	s.mu.Unlock()
+	if s.onObserve != nil {
+		s.once.Do(s.onObserve)
+	}
+	return nil
+}
+
+func (s *recordingSink) Forget(c model.Container) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forgotten = append(s.forgotten, c.Name)
+}
+
+// seriesNames returns the container names of the series, sorted.
+func seriesNames(list []model.ContainerSeries) []string {
+	var names []string
+	for _, cs := range list {
+		names = append(names, cs.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestProfileStream(t *testing.T) {
+	f := dockertest.NewFake()
+	for _, name := range []string{"web", "worker"} {
+		f.AddContainer(dockertest.Container{Name: name, Image: "alpine", Labels: map[string]string{"app": "x"}, Running: true, Stats: withPre(scriptedStats(3)), Interval: statsInterval})
+	}
+	f.AddContainer(dockertest.Container{Name: "other", Image: "alpine", Running: true, Stats: withPre(scriptedStats(3)), Interval: statsInterval})
+
+	r := newMemorySession(t)
+	id := r.Session().ID
+	sink := &recordingSink{}
+	c := docker.NewClientWithAPI(f, r)
+	err := c.GetRuntimeStatistcs(context.Background(), docker.Selector{Labels: []string{"app=x"}}, docker.ProfileOptions{Sinks: []docker.Sink{sink}})
+	if err != nil {
+		t.Fatalf("profiling: %v", err)
+	}
+
+	list := listSession(t, id)
+	if got := seriesNames(list); !slices.Equal(got, []string{"web", "worker"}) {
+		t.Fatalf("profiled %v, want [web worker]", got)
+	}
+	for _, cs := range list {
+		if len(cs.Datapoints) != 3 {
+			t.Errorf("'%s' has %d datapoints, want 3", cs.Name, len(cs.Datapoints))
+		}
+		if got := cs.Datapoints[2].CPUPercentage; got != 30 {
+			t.Errorf("'%s' cpu = %v, want 30", cs.Name, got)
+		}
+	}
+	if sink.observed["web"] != 3 || sink.observed["worker"] != 3 {
+		t.Errorf("sink observed %v, want 3 samples of web and worker", sink.observed)
+	}
+	slices.Sort(sink.forgotten)
+	if !slices.Equal(sink.forgotten, []string{"web", "worker"}) {
+		t.Errorf("sink forgot %v, want [web worker]", sink.forgotten)
+	}
+}
+
+func TestProfileNames(t *testing.T) {
+	f := dockertest.NewFake()
+	for _, name := range []string{"web", "db", "other"} {
+		f.AddContainer(dockertest.Container{Name: name, Image: "alpine", Running: true, Stats: withPre(scriptedStats(2)), Interval: statsInterval})
+	}
+
+	r := newMemorySession(t)
+	id := r.Session().ID
+	c := docker.NewClientWithAPI(f, r)
+	if err := c.GetRuntimeStatistcs(context.Background(), docker.Selector{Names: []string{"web", "/DB"}}, docker.ProfileOptions{}); err != nil {
+		t.Fatalf("profiling: %v", err)
+	}
+
+	// one series per container, none mixing their datapoints
+	list := listSession(t, id)
+	if got := seriesNames(list); !slices.Equal(got, []string{"db", "web"}) {
+		t.Fatalf("profiled %v, want [db web]", got)
+	}
+	for _, cs := range list {
+		if len(cs.Datapoints) != 2 {
+			t.Errorf("'%s' has %d datapoints, want 2", cs.Name, len(cs.Datapoints))
+		}
+	}
+	if list[0].ID == list[1].ID {
+		t.Errorf("both series have the container ID %s", list[0].ID)
+	}
+}
+
+func TestProfilePoll(t *testing.T) {
+	f := dockertest.NewFake()
+	f.AddContainer(dockertest.Container{Name: "web", Image: "alpine", Running: true, Stats: scriptedStats(4)})
+
+	r := newMemorySession(t)
+	id := r.Session().ID
+	c := docker.NewClientWithAPI(f, r)
+	err := c.GetRuntimeStatistcs(context.Background(), docker.Selector{Names: []string{"web"}}, docker.ProfileOptions{Interval: statsInterval})
+	if err != nil {
+		t.Fatalf("profiling: %v", err)
+	}
+
+	list := listSession(t, id)
+	if len(list) != 1 || len(list[0].Datapoints) != 4 {
+		t.Fatalf("listed %v, want 4 datapoints of web", list)
+	}
+	// one-shot stats have no "pre" fields, the previous sample fills them
+	for i, dp := range list[0].Datapoints[1:] {
+		if dp.CPUPercentage != 30 {
+			t.Errorf("datapoint %d cpu = %v, want 30", i+1, dp.CPUPercentage)
+		}
+	}
+}
+
+func TestProfileFollow(t *testing.T) {
+	f := dockertest.NewFake()
+	f.AddContainer(dockertest.Container{Name: "web", Image: "alpine", Running: true, Stats: withPre(scriptedStats(3)), Interval: statsInterval})
+
+	sink := &recordingSink{
+		// events are watched by then
+		onObserve: func() {
+			f.AddContainer(dockertest.Container{Name: "late", Image: "alpine", Running: true, Stats: withPre(scriptedStats(2)), Interval: statsInterval})
+			f.AddContainer(dockertest.Container{Name: "other", Image: "busybox", Running: true, Stats: withPre(scriptedStats(2)), Interval: statsInterval})
+		},
+	}
+	r := newMemorySession(t)
+	id := r.Session().ID
+	c := docker.NewClientWithAPI(f, r)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := c.GetRuntimeStatistcs(ctx, docker.Selector{Image: "alpine"}, docker.ProfileOptions{
+		Follow:    true,
+		UntilExit: true,
+		Sinks:     []docker.Sink{sink},
+	})
+	if err != nil {
+		t.Fatalf("profiling: %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("following didn't stop once the containers exited")
+	}
+
+	list := listSession(t, id)
+	if got := seriesNames(list); !slices.Equal(got, []string{"late", "web"}) {
+		t.Fatalf("profiled %v, want [late web]", got)
+	}
+	for _, cs := range list {
+		want := map[string]int{"web": 3, "late": 2}[cs.Name]
+		if len(cs.Datapoints) != want {
+			t.Errorf("'%s' has %d datapoints, want %d", cs.Name, len(cs.Datapoints), want)
+		}
+	}
+}
+
+func TestProfileStopsOnCancel(t *testing.T) {
+	f := dockertest.NewFake()
+	f.AddContainer(dockertest.Container{Name: "web", Image: "alpine", Running: true, Stats: withPre(scriptedStats(100)), Interval: statsInterval})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink := &recordingSink{onObserve: cancel}
+	r := newMemorySession(t)
+	id := r.Session().ID
+	c := docker.NewClientWithAPI(f, r)
+	begin := time.Now()
+	err := c.GetRuntimeStatistcs(ctx, docker.Selector{Names: []string{"web"}}, docker.ProfileOptions{Sinks: []docker.Sink{sink}})
+	if err != nil {
+		t.Fatalf("profiling: %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > 50*statsInterval {
+		t.Errorf("profiling stopped %s after being cancelled", elapsed)
+	}
+
+	// the samples read before cancelling are flushed, and the session ended
+	s, err := persistence.LoadSession(id)
+	if err != nil {
+		t.Fatalf("loading session: %v", err)
+	}
+	if s.EndedAt == nil {
+		t.Error("session end wasn't recorded")
+	}
+	list := listSession(t, id)
+	if len(list) != 1 || len(list[0].Datapoints) == 0 || len(list[0].Datapoints) == 100 {
+		t.Fatalf("listed %v, want some datapoints of web", list)
+	}
+}
+
+func TestProfileClosesSessionOnError(t *testing.T) {
+	f := dockertest.NewFake()
+	r := newMemorySession(t)
+	id := r.Session().ID
+	c := docker.NewClientWithAPI(f, r)
+
+	// listing the containers fails on a cancelled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.GetRuntimeStatistcs(ctx, docker.Selector{Names: []string{"web"}}, docker.ProfileOptions{}); err == nil {
+		t.Fatal("profiling succeeded, want the container list error")
+	}
+
+	s, err := persistence.LoadSession(id)
+	if err != nil {
+		t.Fatalf("loading session: %v", err)
+	}
+	if s.EndedAt == nil {
+		t.Error("session end wasn't recorded")
+	}
+}
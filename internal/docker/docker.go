@@ -1,17 +1,17 @@
 package docker
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/client"
 	"github.com/eldius/docker-profiler/internal/model"
 	"github.com/eldius/docker-profiler/internal/persistence"
+	"io"
 	"strings"
-	"sync"
+	"time"
 )
 
 var (
@@ -19,11 +19,14 @@ var (
 )
 
 type Client struct {
-	d *client.Client
+	d API
 	r *persistence.Repository
 }
 
-func NewClient(name string) (*Client, error) {
+// NewClient creates a Docker client persisting the collected stats to
+// the session repository. Without repository (nil), the stats only go to
+// the profiling sinks.
+func NewClient(r *persistence.Repository) (*Client, error) {
 	apiClient, err := client.NewClientWithOpts(client.WithHostFromEnv(), client.WithAPIVersionNegotiation())
 	if err != nil {
 		err := fmt.Errorf("%w: %w", ClientBuildErr, err)
@@ -31,64 +34,91 @@ func NewClient(name string) (*Client, error) {
 	}
 	return &Client{
 		d: apiClient,
-		r: persistence.NewRepository(name),
+		r: r,
 	}, nil
 }
 
-func (c Client) GetRuntimeStatistcs(ctx context.Context, name string) error {
-	name = normalizeName(name)
-	containerList, err := c.d.ContainerList(ctx, container.ListOptions{})
+// NewClientWithAPI creates a client calling the given Docker API, such as
+// the fake daemon of the dockertest package.
+func NewClientWithAPI(api API, r *persistence.Repository) *Client {
+	return &Client{
+		d: api,
+		r: r,
+	}
+}
+
+// ProfileOptions tunes how containers get profiled.
+type ProfileOptions struct {
+	// Follow keeps watching Docker events to attach matching containers
+	// started after profiling begins. Profiling then runs until the
+	// context is cancelled.
+	Follow bool
+	// Interval polls one-shot stats at the given rate instead of reading
+	// the daemon stats stream (~1s), when set.
+	Interval time.Duration
+	// UntilExit stops following once every profiled container has exited.
+	// Without Follow, profiling always ends when the containers exit.
+	UntilExit bool
+	// Record saves every raw stats document received, as newline-delimited
+	// JSON tagged with the container start time, when set.
+	Record io.Writer
+	// Sinks receive every sample collected, next to the session
+	// repository.
+	Sinks []Sink
+}
+
+// GetRuntimeStatistcs profiles every running container matching the
+// selector at the same time. Cancelling the context stops profiling
+// gracefully: the samples in flight get persisted and the session is
+// flushed before it returns, whether profiling succeeded or not.
+func (c Client) GetRuntimeStatistcs(ctx context.Context, sel Selector, opts ProfileOptions) (err error) {
+	col := newCollector(c, sel, opts)
+	defer func() {
+		col.closeAll()
+		col.wait()
+		err = errors.Join(err, c.close())
+	}()
+
+	// streams outlive the context, so they can be drained on cancellation
+	streamCtx := context.WithoutCancel(ctx)
+
+	var evs <-chan events.Message
+	var errs <-chan error
+	if opts.Follow {
+		// subscribing before listing, so no container start gets lost in between
+		evCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		evs, errs = c.d.Events(evCtx, types.EventsOptions{Filters: sel.EventFilters()})
+	}
+
+	containerList, err := c.d.ContainerList(ctx, sel.ListOptions())
 	if err != nil {
 		return err
 	}
 
-	var finishFuncs []func()
-	var wg sync.WaitGroup
-
 	for _, instance := range containerList {
-		iName := normalizeName(instance.Names[0])
-		if strings.EqualFold(iName, name) {
-			wg.Add(1)
-			fmt.Printf("- %v\n\n", iName)
-			s, err := c.d.ContainerStats(ctx, instance.ID, true)
-			if err != nil {
-				err = fmt.Errorf("fetching container status for '%s': %w", iName, err)
-				return err
-			}
-			finishFuncs = append(finishFuncs, func() {
-				_ = s.Body.Close()
-			})
-
-			go func(wg *sync.WaitGroup) {
-				sc := bufio.NewScanner(s.Body)
-				defer wg.Done()
-				var stats model.ContainerStats
-
-				for sc.Scan() {
-					_ = json.Unmarshal(sc.Bytes(), &stats)
-					if err := c.r.Persist(stats); err != nil {
-						err = fmt.Errorf("persisting container stats: %w", err)
-						panic(err)
-					}
-					fmt.Printf("---\n- cpu:\n  - total usage: %v\n  - percent usage: %01.2f%%\n  - online: %v\n", stats.CPUStats.CPUUsage.TotalUsage, stats.CPUUsagePercentage(), stats.CPUStats.OnlineCPUs)
-					fmt.Printf("\n- memory:\n  - limit: %s\n  - usage: %s\n", stats.MemoryLimitStr(), stats.MemoryUsageStr())
-				}
-			}(&wg)
+		if !sel.Matches(instance) {
+			continue
+		}
+		if err := col.attach(streamCtx, instance.ID); err != nil {
+			return err
 		}
 	}
 
-	wg.Wait()
-	defer func() {
-		for _, ff := range finishFuncs {
-			ff()
+	if opts.Follow {
+		if err := col.follow(ctx, evs, errs, opts.UntilExit); err != nil {
+			return err
 		}
-	}()
+		col.closeAll()
+	}
 
-	return c.r.Close()
+	col.drain(ctx)
+
+	return nil
 }
 
-func (c Client) List() ([]model.MetricsDatapoint, error) {
-	list, err := c.r.List()
+func (c Client) List(opts persistence.ListOptions) ([]model.ContainerSeries, error) {
+	list, err := c.r.List(opts)
 	if err != nil {
 		err = fmt.Errorf("trying to list datapoints: %w", err)
 		return nil, err
@@ -97,6 +127,50 @@ func (c Client) List() ([]model.MetricsDatapoint, error) {
 	return list, nil
 }
 
+// register records the container image and limits in the session.
+func (c Client) register(ctx context.Context, mc model.Container, info types.ContainerJSON) (model.SessionContainer, error) {
+	sc := model.SessionContainer{
+		Container: mc,
+		Image:     info.Image,
+	}
+	if info.Config != nil {
+		sc.Image = info.Config.Image
+	}
+	sc.ImageDigest = info.Image
+	if img, _, err := c.d.ImageInspectWithRaw(ctx, info.Image); err == nil && len(img.RepoDigests) > 0 {
+		sc.ImageDigest = img.RepoDigests[0]
+	}
+	if hc := info.HostConfig; hc != nil {
+		sc.Limits = model.Limits{
+			Memory:     hc.Memory,
+			MemorySwap: hc.MemorySwap,
+			NanoCPUs:   hc.NanoCPUs,
+			CPUQuota:   hc.CPUQuota,
+			CPUPeriod:  hc.CPUPeriod,
+			CPUShares:  hc.CPUShares,
+			CpusetCpus: hc.CpusetCpus,
+		}
+		if hc.PidsLimit != nil {
+			sc.Limits.PidsLimit = *hc.PidsLimit
+		}
+	}
+	if c.r == nil {
+		return sc, nil
+	}
+	if err := c.r.RegisterContainer(sc); err != nil {
+		return sc, fmt.Errorf("registering container '%s': %w", mc.Name, err)
+	}
+	return sc, nil
+}
+
+// close flushes the session repository, if any.
+func (c Client) close() error {
+	if c.r == nil {
+		return nil
+	}
+	return c.r.Close()
+}
+
 func normalizeName(name string) string {
 	return strings.TrimLeft(name, "/")
 }
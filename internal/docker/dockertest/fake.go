@@ -0,0 +1,559 @@
+package dockertest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+	"github.com/eldius/docker-profiler/internal/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stopExitCode is the exit code of containers stopped by ContainerStop
+// (128 + SIGTERM).
+const stopExitCode = 143
+
+// Container is a scripted container of the fake daemon.
+type Container struct {
+	ID     string
+	Name   string
+	Image  string
+	Labels map[string]string
+	// HostConfig holds the container limits (optional).
+	HostConfig *container.HostConfig
+	// Running containers are started as soon as they're added.
+	Running bool
+	// Stats are the documents served, in order, by the stats endpoints.
+	// The container exits once they're all served (an Interval after the
+	// last one, when streaming).
+	Stats []types.StatsJSON
+	// Interval is the pause between the streamed documents.
+	Interval time.Duration
+	// ExitCode and OOMKilled describe the exit after the last document.
+	ExitCode  int64
+	OOMKilled bool
+}
+
+// state is the lifecycle of a fake container.
+type state struct {
+	Container
+	startedAt  time.Time
+	finishedAt time.Time
+	started    chan struct{}
+	exited     chan struct{}
+	// next is the next stats document served
+	next int
+}
+
+// Fake is an in-process Docker daemon serving scripted containers and
+// stats, for exercising the profiler without a real daemon.
+type Fake struct {
+	// Template is the script of the containers created through
+	// ContainerCreate (the ID, name and image come from the request).
+	Template Container
+
+	mu          sync.Mutex
+	containers  map[string]*state
+	images      map[string]types.ImageInspect
+	subscribers map[chan events.Message]filters.Args
+}
+
+var _ docker.API = (*Fake)(nil)
+
+// NewFake creates a fake daemon with no containers.
+func NewFake() *Fake {
+	return &Fake{
+		containers:  make(map[string]*state),
+		images:      make(map[string]types.ImageInspect),
+		subscribers: make(map[chan events.Message]filters.Args),
+	}
+}
+
+// AddContainer adds the scripted container, starting it when Running is
+// set. A missing ID is generated.
+func (f *Fake) AddContainer(c Container) string {
+	if c.ID == "" {
+		c.ID = newID()
+	}
+	running := c.Running
+	c.Running = false
+	st := &state{
+		Container: c,
+		started:   make(chan struct{}),
+		exited:    make(chan struct{}),
+	}
+
+	f.mu.Lock()
+	f.containers[c.ID] = st
+	f.mu.Unlock()
+
+	if running {
+		f.start(st)
+	}
+	return c.ID
+}
+
+// AddImage adds the image, so inspecting it returns its repo digests.
+func (f *Fake) AddImage(img types.ImageInspect) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.images[img.ID] = img
+	for _, tag := range img.RepoTags {
+		f.images[normalizeRef(tag)] = img
+	}
+}
+
+func (f *Fake) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var resp []types.Container
+	for _, st := range f.containers {
+		if !options.All && !st.running() {
+			continue
+		}
+		if !matches(options.Filters, st.Labels, st.Image) || !matchesID(options.Filters, st.ID) {
+			continue
+		}
+		resp = append(resp, st.summary())
+	}
+	return resp, nil
+}
+
+func (f *Fake) ContainerInspect(_ context.Context, containerID string) (types.ContainerJSON, error) {
+	st, err := f.find(containerID)
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return st.inspect(), nil
+}
+
+// ContainerStats streams the remaining stats documents of the container,
+// once it's started. The stream ends when the container exits or the
+// body gets closed.
+func (f *Fake) ContainerStats(ctx context.Context, containerID string, stream bool) (types.ContainerStats, error) {
+	st, err := f.find(containerID)
+	if err != nil {
+		return types.ContainerStats{}, err
+	}
+	if !stream {
+		return f.ContainerStatsOneShot(ctx, containerID)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		select {
+		case <-st.started:
+		case <-ctx.Done():
+			_ = pw.CloseWithError(ctx.Err())
+			return
+		}
+		enc := json.NewEncoder(pw)
+		for {
+			stats, ok := f.nextStats(st)
+			if !ok {
+				_ = pw.Close()
+				return
+			}
+			if err := enc.Encode(stats); err != nil {
+				return
+			}
+			select {
+			case <-time.After(st.Interval):
+			case <-ctx.Done():
+				_ = pw.CloseWithError(ctx.Err())
+				return
+			}
+		}
+	}()
+	return types.ContainerStats{Body: pr, OSType: "linux"}, nil
+}
+
+// ContainerStatsOneShot returns the next stats document of the container,
+// or an empty one (as the daemon does) when it isn't running.
+func (f *Fake) ContainerStatsOneShot(_ context.Context, containerID string) (types.ContainerStats, error) {
+	st, err := f.find(containerID)
+	if err != nil {
+		return types.ContainerStats{}, err
+	}
+	var doc any = types.StatsJSON{}
+	if stats, ok := f.nextStats(st); ok {
+		doc = stats
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return types.ContainerStats{}, err
+	}
+	return types.ContainerStats{Body: io.NopCloser(strings.NewReader(string(b))), OSType: "linux"}, nil
+}
+
+// Events streams the container start and die events matching the filters
+// until the context is done.
+func (f *Fake) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	sub := make(chan events.Message, 64)
+	msgs := make(chan events.Message)
+	errs := make(chan error, 1)
+
+	f.mu.Lock()
+	f.subscribers[sub] = options.Filters
+	f.mu.Unlock()
+
+	go func() {
+		defer func() {
+			f.mu.Lock()
+			delete(f.subscribers, sub)
+			f.mu.Unlock()
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			case ev := <-sub:
+				select {
+				case msgs <- ev:
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return
+				}
+			}
+		}
+	}()
+	return msgs, errs
+}
+
+func (f *Fake) ImageInspectWithRaw(_ context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	img, ok := f.images[imageID]
+	if !ok {
+		img, ok = f.images[normalizeRef(imageID)]
+	}
+	if !ok {
+		return types.ImageInspect{}, nil, errdefs.NotFound(fmt.Errorf("no such image: %s", imageID))
+	}
+	raw, err := json.Marshal(img)
+	return img, raw, err
+}
+
+// ImagePull adds the image as if it had been pulled.
+func (f *Fake) ImagePull(_ context.Context, refStr string, _ image.PullOptions) (io.ReadCloser, error) {
+	f.AddImage(types.ImageInspect{ID: "sha256:" + newID(), RepoTags: []string{refStr}})
+	return io.NopCloser(strings.NewReader(`{"status":"Pulled"}` + "\n")), nil
+}
+
+// ContainerCreate creates a container scripted after the Template, failing
+// as the daemon does when its image is missing.
+func (f *Fake) ContainerCreate(_ context.Context, config *container.Config, hostConfig *container.HostConfig, _ *network.NetworkingConfig, _ *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	f.mu.Lock()
+	_, ok := f.images[normalizeRef(config.Image)]
+	f.mu.Unlock()
+	if !ok {
+		return container.CreateResponse{}, errdefs.NotFound(fmt.Errorf("no such image: %s", config.Image))
+	}
+
+	c := f.Template
+	c.ID = ""
+	c.Name = containerName
+	if c.Name == "" {
+		c.Name = "fake_" + newID()[:8]
+	}
+	c.Image = config.Image
+	c.Labels = config.Labels
+	c.HostConfig = hostConfig
+	c.Running = false
+	return container.CreateResponse{ID: f.AddContainer(c)}, nil
+}
+
+func (f *Fake) ContainerStart(_ context.Context, containerID string, _ container.StartOptions) error {
+	st, err := f.find(containerID)
+	if err != nil {
+		return err
+	}
+	f.start(st)
+	return nil
+}
+
+func (f *Fake) ContainerWait(ctx context.Context, containerID string, _ container.WaitCondition) (<-chan container.WaitResponse, <-chan error) {
+	resC := make(chan container.WaitResponse, 1)
+	errC := make(chan error, 1)
+	st, err := f.find(containerID)
+	if err != nil {
+		errC <- err
+		return resC, errC
+	}
+	go func() {
+		select {
+		case <-st.exited:
+			f.mu.Lock()
+			resC <- container.WaitResponse{StatusCode: st.ExitCode}
+			f.mu.Unlock()
+		case <-ctx.Done():
+			errC <- ctx.Err()
+		}
+	}()
+	return resC, errC
+}
+
+// ContainerStop makes the container exit right away.
+func (f *Fake) ContainerStop(_ context.Context, containerID string, _ container.StopOptions) error {
+	st, err := f.find(containerID)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if st.running() {
+		st.ExitCode = stopExitCode
+		st.OOMKilled = false
+		f.exit(st)
+	}
+	return nil
+}
+
+func (f *Fake) ContainerRemove(_ context.Context, containerID string, options container.RemoveOptions) error {
+	st, err := f.find(containerID)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if st.running() {
+		if !options.Force {
+			return errdefs.Conflict(fmt.Errorf("container %s is running", st.Name))
+		}
+		st.ExitCode = 137
+		f.exit(st)
+	}
+	delete(f.containers, st.ID)
+	f.publish(st, events.ActionDestroy)
+	return nil
+}
+
+// find looks the container up by ID, ID prefix or name.
+func (f *Fake) find(ref string) (*state, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if st, ok := f.containers[ref]; ok {
+		return st, nil
+	}
+	for _, st := range f.containers {
+		if st.Name == strings.TrimPrefix(ref, "/") || (len(ref) >= 12 && strings.HasPrefix(st.ID, ref)) {
+			return st, nil
+		}
+	}
+	return nil, errdefs.NotFound(fmt.Errorf("no such container: %s", ref))
+}
+
+func (f *Fake) start(st *state) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if st.running() || st.finished() {
+		return
+	}
+	st.Running = true
+	st.startedAt = time.Now()
+	close(st.started)
+	f.publish(st, events.ActionStart)
+	if len(st.Stats) == 0 {
+		f.exit(st)
+	}
+}
+
+// nextStats returns the next stats document of the running container,
+// making it exit when asked for one more after the last.
+func (f *Fake) nextStats(st *state) (types.StatsJSON, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !st.running() {
+		return types.StatsJSON{}, false
+	}
+	if st.next >= len(st.Stats) {
+		f.exit(st)
+		return types.StatsJSON{}, false
+	}
+	stats := st.Stats[st.next]
+	st.next++
+	stats.ID = st.ID
+	stats.Name = "/" + st.Name
+	if stats.Read.IsZero() {
+		stats.Read = time.Now()
+	}
+	return stats, true
+}
+
+// exit finishes the container lifecycle, with the lock held.
+func (f *Fake) exit(st *state) {
+	st.Running = false
+	st.finishedAt = time.Now()
+	close(st.exited)
+	f.publish(st, events.ActionDie)
+}
+
+// publish sends the container event to the matching subscribers, with
+// the lock held.
+func (f *Fake) publish(st *state, action events.Action) {
+	attributes := map[string]string{
+		"name":  st.Name,
+		"image": st.Image,
+	}
+	for k, v := range st.Labels {
+		attributes[k] = v
+	}
+	ev := events.Message{
+		Type:   events.ContainerEventType,
+		Action: action,
+		Actor: events.Actor{
+			ID:         st.ID,
+			Attributes: attributes,
+		},
+		Scope:    "local",
+		Time:     time.Now().Unix(),
+		TimeNano: time.Now().UnixNano(),
+	}
+	for sub, args := range f.subscribers {
+		if args.Len() > 0 && args.Contains("event") && !args.ExactMatch("event", string(action)) {
+			continue
+		}
+		if !matches(args, st.Labels, st.Image) {
+			continue
+		}
+		select {
+		case sub <- ev:
+		default:
+		}
+	}
+}
+
+func (st *state) running() bool {
+	return st.Running
+}
+
+func (st *state) finished() bool {
+	return !st.finishedAt.IsZero()
+}
+
+func (st *state) summary() types.Container {
+	s := "exited"
+	if st.running() {
+		s = "running"
+	}
+	return types.Container{
+		ID:     st.ID,
+		Names:  []string{"/" + st.Name},
+		Image:  st.Image,
+		Labels: st.Labels,
+		State:  s,
+	}
+}
+
+func (st *state) inspect() types.ContainerJSON {
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return "0001-01-01T00:00:00Z"
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+	hostConfig := st.HostConfig
+	if hostConfig == nil {
+		hostConfig = &container.HostConfig{}
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    st.ID,
+			Name:  "/" + st.Name,
+			Image: st.Image,
+			State: &types.ContainerState{
+				Running:    st.running(),
+				ExitCode:   int(st.ExitCode),
+				OOMKilled:  st.OOMKilled,
+				StartedAt:  format(st.startedAt),
+				FinishedAt: format(st.finishedAt),
+			},
+			HostConfig: hostConfig,
+		},
+		Config: &container.Config{
+			Image:  st.Image,
+			Labels: st.Labels,
+		},
+	}
+}
+
+// matches applies the label and ancestor/image filters the profiler uses.
+func matches(args filters.Args, labels map[string]string, img string) bool {
+	for _, l := range args.Get("label") {
+		k, v, hasValue := strings.Cut(l, "=")
+		lv, ok := labels[k]
+		if !ok || (hasValue && lv != v) {
+			return false
+		}
+	}
+	for _, key := range []string{"ancestor", "image"} {
+		if refs := args.Get(key); len(refs) > 0 && !containsRef(refs, img) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesID applies the ID (prefix) filter.
+func matchesID(args filters.Args, id string) bool {
+	ids := args.Get("id")
+	for _, prefix := range ids {
+		if strings.HasPrefix(id, prefix) {
+			return true
+		}
+	}
+	return len(ids) == 0
+}
+
+func containsRef(refs []string, img string) bool {
+	for _, ref := range refs {
+		if normalizeRef(ref) == normalizeRef(img) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeRef drops the default registry, namespace and tag of the image
+// reference, so `alpine` and `docker.io/library/alpine:latest` match.
+func normalizeRef(ref string) string {
+	ref = strings.TrimPrefix(ref, "docker.io/")
+	ref = strings.TrimPrefix(ref, "library/")
+	return strings.TrimSuffix(ref, ":latest")
+}
+
+func newID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
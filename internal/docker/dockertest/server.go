@@ -0,0 +1,220 @@
+package dockertest
+
+import (
+	"encoding/json"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+)
+
+// APIVersion is the Engine API version the stand-in server reports.
+const APIVersion = "1.45"
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// NewServer starts a stand-in for the Docker Engine API backed by the fake
+// daemon, for exercising the real Docker client over HTTP. Point the
+// client at it through Host (eg: DOCKER_HOST). Only the endpoints the
+// profiler calls are served.
+func NewServer(f *Fake) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_ping", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "OK")
+	})
+	mux.HandleFunc("HEAD /_ping", func(http.ResponseWriter, *http.Request) {})
+	mux.HandleFunc("GET /containers/json", func(w http.ResponseWriter, r *http.Request) {
+		args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+		if err != nil {
+			writeError(w, errdefs.InvalidParameter(err))
+			return
+		}
+		list, err := f.ContainerList(r.Context(), container.ListOptions{
+			All:     r.URL.Query().Get("all") == "1",
+			Filters: args,
+		})
+		writeJSON(w, list, err)
+	})
+	mux.HandleFunc("GET /containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		info, err := f.ContainerInspect(r.Context(), r.PathValue("id"))
+		writeJSON(w, info, err)
+	})
+	mux.HandleFunc("GET /containers/{id}/stats", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		stream := q.Get("stream") != "0" && q.Get("one-shot") != "1"
+		s, err := f.ContainerStats(r.Context(), r.PathValue("id"), stream)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer func() {
+			_ = s.Body.Close()
+		}()
+		w.Header().Set("Content-Type", "application/json")
+		fw := flushWriter{w}
+		fw.flush()
+		_, _ = io.Copy(fw, s.Body)
+	})
+	mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+		if err != nil {
+			writeError(w, errdefs.InvalidParameter(err))
+			return
+		}
+		msgs, errs := f.Events(r.Context(), types.EventsOptions{Filters: args})
+		w.Header().Set("Content-Type", "application/json")
+		fw := flushWriter{w}
+		fw.flush()
+		enc := json.NewEncoder(fw)
+		for {
+			select {
+			case msg := <-msgs:
+				if err := enc.Encode(msg); err != nil {
+					return
+				}
+			case <-errs:
+				return
+			}
+		}
+	})
+	mux.HandleFunc("GET /images/", func(w http.ResponseWriter, r *http.Request) {
+		ref := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/json")
+		img, _, err := f.ImageInspectWithRaw(r.Context(), ref)
+		writeJSON(w, img, err)
+	})
+	mux.HandleFunc("POST /images/create", func(w http.ResponseWriter, r *http.Request) {
+		ref := r.URL.Query().Get("fromImage")
+		if tag := r.URL.Query().Get("tag"); tag != "" {
+			ref += ":" + tag
+		}
+		body, err := f.ImagePull(r.Context(), ref, image.PullOptions{})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer func() {
+			_ = body.Close()
+		}()
+		_, _ = io.Copy(w, body)
+	})
+	mux.HandleFunc("POST /containers/create", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			*container.Config
+			HostConfig *container.HostConfig
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, errdefs.InvalidParameter(err))
+			return
+		}
+		if req.Config == nil {
+			req.Config = &container.Config{}
+		}
+		resp, err := f.ContainerCreate(r.Context(), req.Config, req.HostConfig, nil, nil, r.URL.Query().Get("name"))
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+		}
+		writeJSON(w, resp, err)
+	})
+	mux.HandleFunc("POST /containers/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+		writeNoContent(w, f.ContainerStart(r.Context(), r.PathValue("id"), container.StartOptions{}))
+	})
+	mux.HandleFunc("POST /containers/{id}/stop", func(w http.ResponseWriter, r *http.Request) {
+		writeNoContent(w, f.ContainerStop(r.Context(), r.PathValue("id"), container.StopOptions{}))
+	})
+	mux.HandleFunc("POST /containers/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := f.find(r.PathValue("id")); err != nil {
+			writeError(w, err)
+			return
+		}
+		resC, errC := f.ContainerWait(r.Context(), r.PathValue("id"), container.WaitCondition(r.URL.Query().Get("condition")))
+		// as the daemon does, the headers go first so the client knows
+		// the wait began, and the result once the container exits
+		w.Header().Set("Content-Type", "application/json")
+		flushWriter{w}.flush()
+		var res container.WaitResponse
+		select {
+		case res = <-resC:
+		case err := <-errC:
+			res.Error = &container.WaitExitError{Message: err.Error()}
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	})
+	mux.HandleFunc("DELETE /containers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		writeNoContent(w, f.ContainerRemove(r.Context(), r.PathValue("id"), container.RemoveOptions{
+			Force: r.URL.Query().Get("force") == "1",
+		}))
+	})
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Api-Version", APIVersion)
+		w.Header().Set("Ostype", "linux")
+		r.URL.Path = versionPrefix.ReplaceAllString(r.URL.Path, "/")
+		mux.ServeHTTP(w, r)
+	}))
+}
+
+// Host returns the Docker host address of the stand-in server.
+func Host(srv *httptest.Server) string {
+	return "tcp://" + srv.Listener.Addr().String()
+}
+
+func writeJSON(w http.ResponseWriter, v any, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeNoContent(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeError replies the error the way the daemon does, so the client
+// maps it back to the same errdefs class.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errdefs.IsNotFound(err):
+		status = http.StatusNotFound
+	case errdefs.IsInvalidParameter(err):
+		status = http.StatusBadRequest
+	case errdefs.IsConflict(err):
+		status = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+	}{err.Error()})
+}
+
+// flushWriter flushes every write, so streamed documents reach the client
+// as soon as they're written.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.flush()
+	return n, err
+}
+
+func (fw flushWriter) flush() {
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
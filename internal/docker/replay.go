@@ -0,0 +1,75 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/eldius/docker-profiler/internal/model"
+	"github.com/eldius/docker-profiler/internal/persistence"
+	"io"
+	"time"
+)
+
+// Replay feeds recorded raw stats documents through the same decode,
+// persist and print pipeline as profiling, no daemon needed. Speed scales
+// the pauses between samples by their read time: 1 replays in real time,
+// 10 ten times faster and 0 without pausing. Cancelling the context stops
+// the replay, keeping what was persisted so far.
+func Replay(ctx context.Context, r *persistence.Repository, in io.Reader, speed float64) error {
+	err := replay(ctx, newCollector(Client{r: r}, Selector{}, ProfileOptions{}), in, speed)
+	return errors.Join(err, r.Close())
+}
+
+// replay handles the recorded documents by container lifecycle, skipping
+// the invalid ones as profiling does.
+func replay(ctx context.Context, col *collector, in io.Reader, speed float64) error {
+	streams := make(map[string]*stream)
+	prevs := make(map[string]*model.ContainerStats)
+	var last time.Time
+
+	dec := model.NewStatsDecoder(in)
+	for {
+		var stats model.ContainerStats
+		err := dec.Decode(&stats)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, model.ErrInvalidStats) {
+			fmt.Printf("skipping stats: %v\n", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if speed > 0 && !last.IsZero() && stats.Read.After(last) {
+			pause := time.NewTimer(time.Duration(float64(stats.Read.Sub(last)) / speed))
+			select {
+			case <-ctx.Done():
+				pause.Stop()
+				return nil
+			case <-pause.C:
+			}
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !stats.Read.IsZero() {
+			last = stats.Read
+		}
+
+		c := stats.Container()
+		st, ok := streams[c.Segment()]
+		if !ok {
+			st = &stream{
+				container: model.SessionContainer{Container: c},
+				stop:      func() {},
+			}
+			streams[c.Segment()] = st
+			fmt.Printf("- %v\n\n", st.container.Name)
+		}
+		fillPre(&stats, prevs[c.Segment()])
+		col.handle(st, stats)
+		prevs[c.Segment()] = &stats
+	}
+}
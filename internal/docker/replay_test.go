@@ -0,0 +1,130 @@
+package docker_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/eldius/docker-profiler/internal/docker"
+	"github.com/eldius/docker-profiler/internal/docker/dockertest"
+	"github.com/eldius/docker-profiler/internal/model"
+	"github.com/eldius/docker-profiler/internal/persistence"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newMemorySession records a session in memory, under a temporary data
+// directory.
+func newMemorySession(t *testing.T) *persistence.Repository {
+	t.Helper()
+	persistence.SetDataDir(t.TempDir())
+	t.Cleanup(func() {
+		persistence.SetDataDir("")
+	})
+	r, err := persistence.NewSession(persistence.SessionOptions{Storage: persistence.Memory})
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+	return r
+}
+
+// listSession lists the datapoints of the closed session.
+func listSession(t *testing.T, id string) []model.ContainerSeries {
+	t.Helper()
+	r, err := persistence.NewRepository(id)
+	if err != nil {
+		t.Fatalf("opening session: %v", err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	list, err := r.List(persistence.ListOptions{Resolution: persistence.Raw})
+	if err != nil {
+		t.Fatalf("listing datapoints: %v", err)
+	}
+	return list
+}
+
+func TestReplayFixture(t *testing.T) {
+	f, err := os.Open("../model/testdata/stats.ndjson")
+	if err != nil {
+		t.Fatalf("opening fixture: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	r := newMemorySession(t)
+	id := r.Session().ID
+	if err := docker.Replay(context.Background(), r, f, 0); err != nil {
+		t.Fatalf("replaying fixture: %v", err)
+	}
+
+	list := listSession(t, id)
+	if len(list) != 2 {
+		t.Fatalf("listed %d series, want 2", len(list))
+	}
+	for _, cs := range list {
+		if len(cs.Datapoints) != 5 {
+			t.Errorf("'%s' has %d datapoints, want 5", cs.Name, len(cs.Datapoints))
+		}
+	}
+	if got := list[1].Datapoints[4].CPUPercentage; got != 50 {
+		t.Errorf("web cpu = %v, want 50", got)
+	}
+}
+
+func TestReplaySkipsInvalidDocuments(t *testing.T) {
+	r := newMemorySession(t)
+	id := r.Session().ID
+	in := strings.Join([]string{
+		`{"id":"web","name":"/web","read":"2024-03-01T10:00:01Z","memory_stats":{"usage":1}}`,
+		`{"id":"web","name":"/web","read":`,
+		`{"id":"web","name":"/web","read":"2024-03-01T10:00:03Z","memory_stats":{"usage":3}}`,
+	}, "\n")
+	if err := docker.Replay(context.Background(), r, strings.NewReader(in), 0); err != nil {
+		t.Fatalf("replaying: %v", err)
+	}
+
+	list := listSession(t, id)
+	if len(list) != 1 || len(list[0].Datapoints) != 2 {
+		t.Fatalf("listed %v, want the 2 valid datapoints of web", list)
+	}
+	if got := list[0].Datapoints[1].MemoryUsage; got != 3 {
+		t.Errorf("memory usage = %v, want 3", got)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	f := dockertest.NewFake()
+	f.AddContainer(dockertest.Container{Name: "web", Image: "alpine", Running: true, Stats: withPre(scriptedStats(3)), Interval: statsInterval})
+
+	var rec bytes.Buffer
+	r := newMemorySession(t)
+	profiled := r.Session().ID
+	c := docker.NewClientWithAPI(f, r)
+	if err := c.GetRuntimeStatistcs(context.Background(), docker.Selector{Names: []string{"web"}}, docker.ProfileOptions{Record: &rec}); err != nil {
+		t.Fatalf("profiling: %v", err)
+	}
+	// a truncated document, as an interrupted recording leaves
+	rec.WriteString(`{"id":` + "\n")
+
+	r, err := persistence.NewSession(persistence.SessionOptions{Storage: persistence.Memory})
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+	replayed := r.Session().ID
+	if err := docker.Replay(context.Background(), r, &rec, 0); err != nil {
+		t.Fatalf("replaying recording: %v", err)
+	}
+
+	want, got := listSession(t, profiled), listSession(t, replayed)
+	if len(got) != 1 || len(got[0].Datapoints) != 3 {
+		t.Fatalf("replayed %v, want the 3 datapoints of web", got)
+	}
+	if got[0].StartedAt.IsZero() || !got[0].StartedAt.Equal(want[0].StartedAt) {
+		t.Errorf("replayed web started at %s, want %s", got[0].StartedAt, want[0].StartedAt)
+	}
+	if got[0].Segment() != want[0].Segment() {
+		t.Errorf("replayed lifecycle %s, want %s", got[0].Segment(), want[0].Segment())
+	}
+}
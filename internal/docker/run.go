@@ -0,0 +1,193 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+	"github.com/eldius/docker-profiler/internal/model"
+	"io"
+	"time"
+)
+
+// RunOptions describes the container to be created and profiled.
+type RunOptions struct {
+	Image string
+	Cmd   []string
+	Env   []string
+	// Name is the container name (optional).
+	Name string
+	// Memory is the memory limit in bytes (0 means unlimited).
+	Memory int64
+	// NanoCPUs is the CPU quota in units of 1e-9 CPUs (0 means unlimited).
+	NanoCPUs int64
+	// Remove removes the container after it exits.
+	Remove bool
+	// Interval polls one-shot stats at the given rate instead of reading
+	// the daemon stats stream (~1s), when set.
+	Interval time.Duration
+	// Record saves every raw stats document received, as newline-delimited
+	// JSON tagged with the container start time, when set.
+	Record io.Writer
+	// Sinks receive every sample collected, next to the session
+	// repository.
+	Sinks []Sink
+}
+
+// Run creates and starts a container, profiling it from its very first
+// second until it exits. Cancelling the context stops the container, so its
+// exit still gets recorded. The session is flushed before it returns,
+// whether profiling succeeded or not.
+func (c Client) Run(ctx context.Context, opts RunOptions) (_ *model.ContainerExit, err error) {
+	defer func() {
+		err = errors.Join(err, c.close())
+	}()
+	id, err := c.create(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	// once created, the container gets followed up to its exit even if
+	// the context is cancelled
+	runCtx := context.WithoutCancel(ctx)
+	if opts.Remove {
+		defer func() {
+			if err := c.d.ContainerRemove(context.Background(), id, container.RemoveOptions{Force: true}); err != nil {
+				fmt.Printf("failed to remove container '%s': %v\n", id, err)
+			}
+		}()
+	}
+
+	info, err := c.d.ContainerInspect(runCtx, id)
+	if err != nil {
+		return nil, fmt.Errorf("inspecting container '%s': %w", id, err)
+	}
+	mc := model.Container{
+		ID:   info.ID,
+		Name: normalizeName(info.Name),
+	}
+	sc, err := c.register(runCtx, mc, info)
+	if err != nil {
+		return nil, err
+	}
+
+	// waiting and streaming must begin before the container starts,
+	// otherwise the first samples (or even the exit) could be missed
+	waitCh, waitErrCh := c.d.ContainerWait(runCtx, id, container.WaitConditionNextExit)
+
+	col := newCollector(c, Selector{}, ProfileOptions{
+		Interval: opts.Interval,
+		Record:   opts.Record,
+		Sinks:    opts.Sinks,
+	})
+	defer func() {
+		col.closeAll()
+		col.wait()
+	}()
+	if opts.Interval == 0 {
+		if err := col.open(runCtx, sc); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.d.ContainerStart(ctx, id, container.StartOptions{}); err != nil {
+		return nil, fmt.Errorf("starting container '%s': %w", mc.Name, err)
+	}
+	if opts.Interval > 0 {
+		// the poller stops on a not running container, so it can only
+		// begin once started (its first poll is immediate)
+		if err := col.open(runCtx, sc); err != nil {
+			return nil, err
+		}
+	}
+
+	exit := &model.ContainerExit{}
+	done := ctx.Done()
+	for exited := false; !exited; {
+		select {
+		case res := <-waitCh:
+			exit.Code = res.StatusCode
+			if res.Error != nil {
+				return nil, fmt.Errorf("waiting for container '%s': %s", mc.Name, res.Error.Message)
+			}
+			exited = true
+		case err := <-waitErrCh:
+			return nil, fmt.Errorf("waiting for container '%s': %w", mc.Name, err)
+		case <-done:
+			done = nil
+			fmt.Printf("stopping container '%s'...\n", mc.Name)
+			if err := c.d.ContainerStop(runCtx, id, container.StopOptions{}); err != nil {
+				return nil, fmt.Errorf("stopping container '%s': %w", mc.Name, err)
+			}
+		}
+	}
+	exit.At = time.Now()
+
+	col.closeAll()
+	col.wait()
+
+	info, err = c.d.ContainerInspect(runCtx, id)
+	if err != nil {
+		return nil, fmt.Errorf("inspecting container '%s': %w", mc.Name, err)
+	}
+	if info.State != nil {
+		exit.OOMKilled = info.State.OOMKilled
+		if finishedAt, err := time.Parse(time.RFC3339Nano, info.State.FinishedAt); err == nil {
+			exit.At = finishedAt
+		}
+	}
+
+	if c.r != nil {
+		if err := c.r.PersistExit(mc, *exit); err != nil {
+			return nil, fmt.Errorf("persisting container exit: %w", err)
+		}
+	}
+
+	return exit, nil
+}
+
+// create creates the container, pulling its image when it's missing.
+func (c Client) create(ctx context.Context, opts RunOptions) (string, error) {
+	cfg := &container.Config{
+		Image: opts.Image,
+		Cmd:   opts.Cmd,
+		Env:   opts.Env,
+	}
+	hostCfg := &container.HostConfig{
+		Resources: container.Resources{
+			Memory:   opts.Memory,
+			NanoCPUs: opts.NanoCPUs,
+		},
+	}
+
+	resp, err := c.d.ContainerCreate(ctx, cfg, hostCfg, nil, nil, opts.Name)
+	if errdefs.IsNotFound(err) {
+		if err := c.pull(ctx, opts.Image); err != nil {
+			return "", err
+		}
+		resp, err = c.d.ContainerCreate(ctx, cfg, hostCfg, nil, nil, opts.Name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("creating container from '%s': %w", opts.Image, err)
+	}
+	for _, w := range resp.Warnings {
+		fmt.Printf("warning: %s\n", w)
+	}
+	return resp.ID, nil
+}
+
+func (c Client) pull(ctx context.Context, ref string) error {
+	fmt.Printf("pulling image '%s'...\n", ref)
+	r, err := c.d.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("pulling image '%s': %w", ref, err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("pulling image '%s': %w", ref, err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package docker_test
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/eldius/docker-profiler/internal/docker"
+	"github.com/eldius/docker-profiler/internal/docker/dockertest"
+	"testing"
+)
+
+func TestRunOverHTTP(t *testing.T) {
+	f := dockertest.NewFake()
+	f.AddImage(types.ImageInspect{ID: "sha256:abc", RepoTags: []string{"alpine"}, RepoDigests: []string{"alpine@sha256:abc"}})
+	f.Template = dockertest.Container{Stats: withPre(scriptedStats(3)), Interval: statsInterval, ExitCode: 3}
+	srv := dockertest.NewServer(f)
+	defer srv.Close()
+	t.Setenv("DOCKER_HOST", dockertest.Host(srv))
+
+	r := newMemorySession(t)
+	id := r.Session().ID
+	c, err := docker.NewClient(r)
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	exit, err := c.Run(context.Background(), docker.RunOptions{Image: "alpine", Name: "job", Memory: 64 << 20, Remove: true})
+	if err != nil {
+		t.Fatalf("running container: %v", err)
+	}
+	if exit.Code != 3 || exit.OOMKilled {
+		t.Errorf("exit = %+v, want code 3", exit)
+	}
+
+	list := listSession(t, id)
+	if len(list) != 1 || list[0].Name != "job" {
+		t.Fatalf("listed %v, want the job container", seriesNames(list))
+	}
+	job := list[0]
+	if len(job.Datapoints) != 3 {
+		t.Errorf("job has %d datapoints, want 3", len(job.Datapoints))
+	}
+	if job.Exit == nil || job.Exit.Code != 3 {
+		t.Errorf("recorded exit = %+v, want code 3", job.Exit)
+	}
+	if job.ImageDigest != "alpine@sha256:abc" || job.Limits.Memory != 64<<20 {
+		t.Errorf("recorded image digest %q and memory limit %d, want alpine@sha256:abc and 64MiB", job.ImageDigest, job.Limits.Memory)
+	}
+}
+
+func TestRunPullsMissingImage(t *testing.T) {
+	f := dockertest.NewFake()
+	f.Template = dockertest.Container{Stats: withPre(scriptedStats(1)), Interval: statsInterval}
+
+	r := newMemorySession(t)
+	c := docker.NewClientWithAPI(f, r)
+	exit, err := c.Run(context.Background(), docker.RunOptions{Image: "busybox", Name: "job"})
+	if err != nil {
+		t.Fatalf("running container: %v", err)
+	}
+	if exit.Code != 0 {
+		t.Errorf("exit code = %d, want 0", exit.Code)
+	}
+	if _, _, err := f.ImageInspectWithRaw(context.Background(), "busybox"); err != nil {
+		t.Errorf("image wasn't pulled: %v", err)
+	}
+}
+
+func TestRunRecordsOOMKill(t *testing.T) {
+	f := dockertest.NewFake()
+	f.Template = dockertest.Container{Stats: withPre(scriptedStats(2)), Interval: statsInterval, ExitCode: 137, OOMKilled: true}
+
+	r := newMemorySession(t)
+	id := r.Session().ID
+	c := docker.NewClientWithAPI(f, r)
+	exit, err := c.Run(context.Background(), docker.RunOptions{Image: "alpine", Name: "job"})
+	if err != nil {
+		t.Fatalf("running container: %v", err)
+	}
+	if exit.Code != 137 || !exit.OOMKilled {
+		t.Errorf("exit = %+v, want OOM killed 137", exit)
+	}
+	list := listSession(t, id)
+	if len(list) != 1 || list[0].Exit == nil || !list[0].Exit.OOMKilled {
+		t.Fatalf("listed %v, want the OOM kill of job recorded", list)
+	}
+	// profiled from the very first sample
+	if len(list[0].Datapoints) != 2 {
+		t.Errorf("job has %d datapoints, want 2", len(list[0].Datapoints))
+	}
+}
+
+func TestRunStopsContainerOnCancel(t *testing.T) {
+	f := dockertest.NewFake()
+	f.Template = dockertest.Container{Stats: withPre(scriptedStats(1000)), Interval: statsInterval}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := newMemorySession(t)
+	id := r.Session().ID
+	c := docker.NewClientWithAPI(f, r)
+	exit, err := c.Run(ctx, docker.RunOptions{Image: "alpine", Name: "job", Sinks: []docker.Sink{&recordingSink{onObserve: cancel}}})
+	if err != nil {
+		t.Fatalf("running container: %v", err)
+	}
+	// stopped with SIGTERM
+	if exit.Code != 143 {
+		t.Errorf("exit code = %d, want 143", exit.Code)
+	}
+	list := listSession(t, id)
+	if len(list) != 1 || list[0].Exit == nil || list[0].Exit.Code != 143 {
+		t.Errorf("listed %v, want the stopped job exit recorded", list)
+	}
+}
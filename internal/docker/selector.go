@@ -0,0 +1,115 @@
+package docker
+
+import (
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"strings"
+)
+
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+// Selector describes which containers should be profiled. Every
+// criteria set must match for a container to be selected.
+type Selector struct {
+	// Names are exact container names (any of them matches).
+	Names []string
+	// Labels are `key` or `key=value` label filters.
+	Labels []string
+	// Image selects containers created from the image or its descendants.
+	Image string
+	// ComposeProject selects containers of a docker compose project.
+	ComposeProject string
+	// ComposeService selects containers of a docker compose service.
+	ComposeService string
+}
+
+// IsEmpty tells if no criteria was given.
+func (s Selector) IsEmpty() bool {
+	return len(s.Names) == 0 &&
+		len(s.Labels) == 0 &&
+		s.Image == "" &&
+		s.ComposeProject == "" &&
+		s.ComposeService == ""
+}
+
+// Filters returns the Docker API filters for the selector criteria.
+// Names are not included as the API name filter is a partial match.
+func (s Selector) Filters() filters.Args {
+	args := filters.NewArgs()
+	s.addLabelFilters(args)
+	if s.Image != "" {
+		args.Add("ancestor", s.Image)
+	}
+	return args
+}
+
+// ListOptions returns the options to list the selected containers.
+func (s Selector) ListOptions() container.ListOptions {
+	return container.ListOptions{
+		Filters: s.Filters(),
+	}
+}
+
+// Matches tells if the listed container is selected.
+func (s Selector) Matches(c types.Container) bool {
+	if len(s.Names) == 0 {
+		return true
+	}
+	for _, n := range c.Names {
+		if s.matchesName(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Selector) matchesName(name string) bool {
+	name = normalizeName(name)
+	for _, n := range s.Names {
+		if strings.EqualFold(normalizeName(n), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainerListOptions returns the options to list the container, only
+// when it's selected. Events can't be filtered by ancestor image, so the
+// started containers get checked against the list filters instead.
+func (s Selector) ContainerListOptions(id string) container.ListOptions {
+	opts := s.ListOptions()
+	opts.Filters.Add("id", id)
+	return opts
+}
+
+// EventFilters returns the Docker API filters to watch the lifecycle
+// events of the selected containers. The image isn't included, as the
+// events image filter doesn't match the descendant images the list
+// ancestor filter does.
+func (s Selector) EventFilters() filters.Args {
+	args := filters.NewArgs(
+		filters.Arg("type", string(events.ContainerEventType)),
+		filters.Arg("event", string(events.ActionStart)),
+		filters.Arg("event", string(events.ActionDie)),
+		filters.Arg("event", string(events.ActionDestroy)),
+	)
+	s.addLabelFilters(args)
+	return args
+}
+
+func (s Selector) addLabelFilters(args filters.Args) {
+	for _, l := range s.Labels {
+		args.Add("label", l)
+	}
+	if s.ComposeProject != "" {
+		args.Add("label", composeProjectLabel+"="+s.ComposeProject)
+	}
+	if s.ComposeService != "" {
+		args.Add("label", composeServiceLabel+"="+s.ComposeService)
+	}
+}
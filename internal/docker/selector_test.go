@@ -0,0 +1,91 @@
+package docker_test
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/eldius/docker-profiler/internal/docker"
+	"github.com/eldius/docker-profiler/internal/docker/dockertest"
+	"slices"
+	"testing"
+)
+
+func TestSelectorFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		sel      docker.Selector
+		labels   []string
+		ancestor []string
+	}{
+		{"empty", docker.Selector{}, nil, nil},
+		{"labels", docker.Selector{Labels: []string{"app=x", "tier"}}, []string{"app=x", "tier"}, nil},
+		{"image", docker.Selector{Image: "alpine:3.19"}, nil, []string{"alpine:3.19"}},
+		{
+			"compose",
+			docker.Selector{ComposeProject: "shop", ComposeService: "api"},
+			[]string{"com.docker.compose.project=shop", "com.docker.compose.service=api"},
+			nil,
+		},
+		// names are matched client side, the API filter being partial
+		{"names", docker.Selector{Names: []string{"web"}}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.sel.ListOptions().Filters
+			labels, ancestor := args.Get("label"), args.Get("ancestor")
+			slices.Sort(labels)
+			if !slices.Equal(labels, tt.labels) {
+				t.Errorf("label filters = %v, want %v", labels, tt.labels)
+			}
+			if !slices.Equal(ancestor, tt.ancestor) {
+				t.Errorf("ancestor filters = %v, want %v", ancestor, tt.ancestor)
+			}
+			if got := args.Get("name"); len(got) > 0 {
+				t.Errorf("name filters = %v, want none", got)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	web := types.Container{Names: []string{"/shop-web-1"}}
+	tests := []struct {
+		name string
+		sel  docker.Selector
+		want bool
+	}{
+		{"no names", docker.Selector{Labels: []string{"app=x"}}, true},
+		{"exact name", docker.Selector{Names: []string{"shop-web-1"}}, true},
+		{"case and slash", docker.Selector{Names: []string{"/Shop-Web-1"}}, true},
+		{"any name", docker.Selector{Names: []string{"db", "shop-web-1"}}, true},
+		{"replica prefix", docker.Selector{Names: []string{"shop-web"}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.sel.Matches(web); got != tt.want {
+			t.Errorf("%s: matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProfileComposeService(t *testing.T) {
+	f := dockertest.NewFake()
+	for _, c := range []struct{ name, service string }{{"shop-api-1", "api"}, {"shop-api-2", "api"}, {"shop-db-1", "db"}} {
+		f.AddContainer(dockertest.Container{
+			Name:     c.name,
+			Image:    "alpine",
+			Labels:   map[string]string{"com.docker.compose.project": "shop", "com.docker.compose.service": c.service},
+			Running:  true,
+			Stats:    withPre(scriptedStats(2)),
+			Interval: statsInterval,
+		})
+	}
+
+	r := newMemorySession(t)
+	id := r.Session().ID
+	c := docker.NewClientWithAPI(f, r)
+	if err := c.GetRuntimeStatistcs(context.Background(), docker.Selector{ComposeProject: "shop", ComposeService: "api"}, docker.ProfileOptions{}); err != nil {
+		t.Fatalf("profiling: %v", err)
+	}
+	if got := seriesNames(listSession(t, id)); !slices.Equal(got, []string{"shop-api-1", "shop-api-2"}) {
+		t.Errorf("profiled %v, want both api replicas", got)
+	}
+}
@@ -0,0 +1,15 @@
+package docker
+
+import (
+	"github.com/eldius/docker-profiler/internal/model"
+)
+
+// Sink receives the stats samples collected, next to the session
+// repository (eg: a metrics exporter).
+type Sink interface {
+	// Observe is called with every sample of the container lifecycle.
+	Observe(sc model.SessionContainer, stats model.ContainerStats) error
+	// Forget is called once the container lifecycle isn't profiled
+	// anymore.
+	Forget(c model.Container)
+}
@@ -0,0 +1,320 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eldius/docker-profiler/internal/model"
+	"github.com/parquet-go/parquet-go"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Format is an export file format.
+type Format string
+
+const (
+	CSV     Format = "csv"
+	NDJSON  Format = "ndjson"
+	Parquet Format = "parquet"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown export format")
+)
+
+// ParseFormat parses the format name (`jsonl` is an alias of `ndjson`).
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "csv":
+		return CSV, nil
+	case "ndjson", "jsonl":
+		return NDJSON, nil
+	case "parquet":
+		return Parquet, nil
+	}
+	return "", fmt.Errorf("%w: '%s'", ErrUnknownFormat, name)
+}
+
+// kind is the type of a column values.
+type kind int
+
+const (
+	stringKind kind = iota
+	timeKind
+	floatKind
+)
+
+// column is an exported field, with the value it takes for a datapoint
+// (unset when the datapoint doesn't have it).
+type column struct {
+	name  string
+	kind  kind
+	value func(cs model.ContainerSeries, dp model.MetricsDatapoint) (any, bool)
+}
+
+// Write writes one row per datapoint of the series, with the session and
+// container labels followed by every captured metric. Downsampled series
+// also get their resolution and aggregate. Network, block I/O
+// and per core metrics get one column per interface, device and core.
+func Write(w io.Writer, f Format, series []model.ContainerSeries) error {
+	cols := columns(series)
+	switch f {
+	case CSV:
+		return writeCSV(w, cols, series)
+	case NDJSON:
+		return writeNDJSON(w, cols, series)
+	case Parquet:
+		return writeParquet(w, cols, series)
+	}
+	return fmt.Errorf("%w: '%s'", ErrUnknownFormat, f)
+}
+
+func writeCSV(w io.Writer, cols []column, series []model.ContainerSeries) error {
+	cw := csv.NewWriter(w)
+	header := make([]string, len(cols))
+	for i, c := range cols {
+		header[i] = c.name
+	}
+	if err := cw.Write(header); err != nil {
+		return fmt.Errorf("writing csv header: %w", err)
+	}
+
+	record := make([]string, len(cols))
+	for _, cs := range series {
+		for _, dp := range cs.Datapoints {
+			for i, c := range cols {
+				record[i] = ""
+				v, ok := c.value(cs, dp)
+				if !ok {
+					continue
+				}
+				switch v := v.(type) {
+				case string:
+					record[i] = v
+				case time.Time:
+					record[i] = v.Format(time.RFC3339Nano)
+				case float64:
+					record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+				}
+			}
+			if err := cw.Write(record); err != nil {
+				return fmt.Errorf("writing csv record: %w", err)
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeNDJSON(w io.Writer, cols []column, series []model.ContainerSeries) error {
+	enc := json.NewEncoder(w)
+	for _, cs := range series {
+		for _, dp := range cs.Datapoints {
+			row := make(map[string]any, len(cols))
+			for _, c := range cols {
+				if v, ok := c.value(cs, dp); ok {
+					row[c.name] = v
+				}
+			}
+			if err := enc.Encode(row); err != nil {
+				return fmt.Errorf("writing json line: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func writeParquet(w io.Writer, cols []column, series []model.ContainerSeries) error {
+	group := make(parquet.Group, len(cols))
+	for _, c := range cols {
+		var node parquet.Node
+		switch c.kind {
+		case stringKind:
+			node = parquet.String()
+		case timeKind:
+			node = parquet.Timestamp(parquet.Nanosecond)
+		default:
+			node = parquet.Leaf(parquet.DoubleType)
+		}
+		group[c.name] = parquet.Optional(node)
+	}
+	schema := parquet.NewSchema("datapoint", group)
+
+	// the schema sorts the columns by name, rows must follow its order
+	byName := make(map[string]column, len(cols))
+	for _, c := range cols {
+		byName[c.name] = c
+	}
+	leaves := schema.Columns()
+
+	pw := parquet.NewWriter(w, schema)
+	for _, cs := range series {
+		for _, dp := range cs.Datapoints {
+			row := make(parquet.Row, len(leaves))
+			for i, path := range leaves {
+				v, ok := byName[path[0]].value(cs, dp)
+				if !ok {
+					row[i] = parquet.NullValue().Level(0, 0, i)
+					continue
+				}
+				var pv parquet.Value
+				switch v := v.(type) {
+				case string:
+					pv = parquet.ByteArrayValue([]byte(v))
+				case time.Time:
+					pv = parquet.Int64Value(v.UnixNano())
+				case float64:
+					pv = parquet.DoubleValue(v)
+				}
+				row[i] = pv.Level(0, 1, i)
+			}
+			if _, err := pw.WriteRows([]parquet.Row{row}); err != nil {
+				return fmt.Errorf("writing parquet row: %w", err)
+			}
+		}
+	}
+	if err := pw.Close(); err != nil {
+		return fmt.Errorf("writing parquet file: %w", err)
+	}
+	return nil
+}
+
+// columns lists the labels and metrics columns of the series.
+func columns(series []model.ContainerSeries) []column {
+	cols := []column{
+		label("session_id", func(cs model.ContainerSeries) string { return cs.SessionID }),
+		label("container_id", func(cs model.ContainerSeries) string { return cs.ID }),
+		label("container_name", func(cs model.ContainerSeries) string { return cs.Name }),
+		label("image", func(cs model.ContainerSeries) string { return cs.Image }),
+		{name: "container_started_at", kind: timeKind, value: func(cs model.ContainerSeries, _ model.MetricsDatapoint) (any, bool) {
+			return cs.StartedAt, !cs.StartedAt.IsZero()
+		}},
+		{name: "timestamp", kind: timeKind, value: func(_ model.ContainerSeries, dp model.MetricsDatapoint) (any, bool) {
+			return dp.Timestamp, true
+		}},
+	}
+	// the rollup columns are left out of raw exports
+	if slices.ContainsFunc(series, func(cs model.ContainerSeries) bool { return cs.Resolution != "" }) {
+		cols = append(cols,
+			optionalLabel("resolution", func(cs model.ContainerSeries) string { return cs.Resolution }),
+			optionalLabel("aggregate", func(cs model.ContainerSeries) string { return cs.Aggregate }),
+		)
+	}
+	cols = append(cols,
+		metric("memory_usage", func(dp model.MetricsDatapoint) float64 { return dp.MemoryUsage }),
+		metric("memory_limit", func(dp model.MetricsDatapoint) float64 { return dp.MemoryLimit }),
+		metric("memory_working_set", func(dp model.MetricsDatapoint) float64 { return dp.MemoryWorkingSet }),
+		metric("memory_anon", func(dp model.MetricsDatapoint) float64 { return dp.MemoryAnon }),
+		metric("memory_file", func(dp model.MetricsDatapoint) float64 { return dp.MemoryFile }),
+		metric("memory_shmem", func(dp model.MetricsDatapoint) float64 { return dp.MemoryShmem }),
+		metric("memory_kernel_stack", func(dp model.MetricsDatapoint) float64 { return dp.MemoryKernelStack }),
+		metric("memory_slab", func(dp model.MetricsDatapoint) float64 { return dp.MemorySlab }),
+		metric("cpu_online", func(dp model.MetricsDatapoint) float64 { return dp.CPUOnlineCount }),
+		metric("cpu_usage", func(dp model.MetricsDatapoint) float64 { return dp.CPUUsage }),
+		metric("cpu_percentage", func(dp model.MetricsDatapoint) float64 { return dp.CPUPercentage }),
+		metric("cpu_user_percentage", func(dp model.MetricsDatapoint) float64 { return dp.CPUUserPercentage }),
+		metric("cpu_kernel_percentage", func(dp model.MetricsDatapoint) float64 { return dp.CPUKernelPercentage }),
+		metric("cpu_throttling_periods", func(dp model.MetricsDatapoint) float64 { return dp.ThrottlingPeriods }),
+		metric("cpu_throttled_periods", func(dp model.MetricsDatapoint) float64 { return dp.ThrottledPeriods }),
+		metric("cpu_throttled_time", func(dp model.MetricsDatapoint) float64 { return dp.ThrottledTime }),
+		metric("cpu_throttled_percentage", func(dp model.MetricsDatapoint) float64 { return dp.ThrottledPercentage }),
+		metric("pids_current", func(dp model.MetricsDatapoint) float64 { return dp.PidsCurrent }),
+		metric("pids_limit", func(dp model.MetricsDatapoint) float64 { return dp.PidsLimit }),
+	)
+
+	var interfaces, devices []string
+	cores := 0
+	for _, cs := range series {
+		interfaces = append(interfaces, cs.Interfaces...)
+		devices = append(devices, cs.Devices...)
+		cores = max(cores, cs.Cores)
+	}
+	slices.Sort(interfaces)
+	slices.Sort(devices)
+
+	for _, name := range slices.Compact(interfaces) {
+		cols = append(cols,
+			network(name, "rx_bytes", func(n model.NetworkDatapoint) float64 { return n.RxBytes }),
+			network(name, "rx_packets", func(n model.NetworkDatapoint) float64 { return n.RxPackets }),
+			network(name, "rx_errors", func(n model.NetworkDatapoint) float64 { return n.RxErrors }),
+			network(name, "rx_dropped", func(n model.NetworkDatapoint) float64 { return n.RxDropped }),
+			network(name, "tx_bytes", func(n model.NetworkDatapoint) float64 { return n.TxBytes }),
+			network(name, "tx_packets", func(n model.NetworkDatapoint) float64 { return n.TxPackets }),
+			network(name, "tx_errors", func(n model.NetworkDatapoint) float64 { return n.TxErrors }),
+			network(name, "tx_dropped", func(n model.NetworkDatapoint) float64 { return n.TxDropped }),
+			network(name, "rx_bytes_rate", func(n model.NetworkDatapoint) float64 { return n.RxBytesRate }),
+			network(name, "rx_packets_rate", func(n model.NetworkDatapoint) float64 { return n.RxPacketsRate }),
+			network(name, "tx_bytes_rate", func(n model.NetworkDatapoint) float64 { return n.TxBytesRate }),
+			network(name, "tx_packets_rate", func(n model.NetworkDatapoint) float64 { return n.TxPacketsRate }),
+		)
+	}
+	for _, device := range slices.Compact(devices) {
+		cols = append(cols,
+			blockIO(device, "read_bytes", func(b model.BlockIODatapoint) float64 { return b.ReadBytes }),
+			blockIO(device, "write_bytes", func(b model.BlockIODatapoint) float64 { return b.WriteBytes }),
+			blockIO(device, "read_ops", func(b model.BlockIODatapoint) float64 { return b.ReadOps }),
+			blockIO(device, "write_ops", func(b model.BlockIODatapoint) float64 { return b.WriteOps }),
+			blockIO(device, "read_bytes_rate", func(b model.BlockIODatapoint) float64 { return b.ReadBytesRate }),
+			blockIO(device, "write_bytes_rate", func(b model.BlockIODatapoint) float64 { return b.WriteBytesRate }),
+			blockIO(device, "read_iops", func(b model.BlockIODatapoint) float64 { return b.ReadIOPS }),
+			blockIO(device, "write_iops", func(b model.BlockIODatapoint) float64 { return b.WriteIOPS }),
+		)
+	}
+	for core := 0; core < cores; core++ {
+		cols = append(cols, column{
+			name: fmt.Sprintf("cpu_%d_percentage", core),
+			kind: floatKind,
+			value: func(_ model.ContainerSeries, dp model.MetricsDatapoint) (any, bool) {
+				if core >= len(dp.CPUPerCore) {
+					return nil, false
+				}
+				return dp.CPUPerCore[core], true
+			},
+		})
+	}
+	return cols
+}
+
+func label(name string, v func(cs model.ContainerSeries) string) column {
+	return column{name: name, kind: stringKind, value: func(cs model.ContainerSeries, _ model.MetricsDatapoint) (any, bool) {
+		return v(cs), true
+	}}
+}
+
+// optionalLabel is a label column left unset when empty.
+func optionalLabel(name string, v func(cs model.ContainerSeries) string) column {
+	return column{name: name, kind: stringKind, value: func(cs model.ContainerSeries, _ model.MetricsDatapoint) (any, bool) {
+		s := v(cs)
+		return s, s != ""
+	}}
+}
+
+func metric(name string, v func(dp model.MetricsDatapoint) float64) column {
+	return column{name: name, kind: floatKind, value: func(_ model.ContainerSeries, dp model.MetricsDatapoint) (any, bool) {
+		return v(dp), true
+	}}
+}
+
+func network(iface, name string, v func(n model.NetworkDatapoint) float64) column {
+	return column{name: fmt.Sprintf("network_%s_%s", iface, name), kind: floatKind, value: func(_ model.ContainerSeries, dp model.MetricsDatapoint) (any, bool) {
+		n, ok := dp.Networks[iface]
+		if !ok {
+			return nil, false
+		}
+		return v(n), true
+	}}
+}
+
+func blockIO(device, name string, v func(b model.BlockIODatapoint) float64) column {
+	return column{name: fmt.Sprintf("blkio_%s_%s", device, name), kind: floatKind, value: func(_ model.ContainerSeries, dp model.MetricsDatapoint) (any, bool) {
+		b, ok := dp.BlockIO[device]
+		if !ok {
+			return nil, false
+		}
+		return v(b), true
+	}}
+}
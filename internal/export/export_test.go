@@ -0,0 +1,188 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/eldius/docker-profiler/internal/model"
+	"github.com/parquet-go/parquet-go"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// series returns a container series with two datapoints a minute apart.
+func series(name, resolution, aggregate string) model.ContainerSeries {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	return model.ContainerSeries{
+		SessionID:        "s1",
+		SessionContainer: model.SessionContainer{Container: model.Container{ID: name + "-id", Name: name}},
+		Resolution:       resolution,
+		Aggregate:        aggregate,
+		Datapoints: []model.MetricsDatapoint{
+			{Timestamp: start, MemoryUsage: 100},
+			{Timestamp: start.Add(time.Minute), MemoryUsage: 200},
+		},
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	tests := []struct {
+		name       string
+		series     []model.ContainerSeries
+		rollupCols bool
+		want       [][2]string
+	}{
+		{"raw", []model.ContainerSeries{series("web", "", "")}, false, nil},
+		{
+			"rollup",
+			[]model.ContainerSeries{series("web", "1m", "max"), series("db", "", "")},
+			true,
+			[][2]string{{"1m", "max"}, {"1m", "max"}, {"", ""}, {"", ""}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Write(&buf, CSV, tt.series); err != nil {
+				t.Fatalf("writing csv: %v", err)
+			}
+			records, err := csv.NewReader(&buf).ReadAll()
+			if err != nil {
+				t.Fatalf("reading csv: %v", err)
+			}
+			if len(records) != 1+2*len(tt.series) {
+				t.Fatalf("wrote %d records, want %d", len(records), 1+2*len(tt.series))
+			}
+			header := records[0]
+			res, agg := slices.Index(header, "resolution"), slices.Index(header, "aggregate")
+			if (res >= 0) != tt.rollupCols || (agg >= 0) != tt.rollupCols {
+				t.Fatalf("header = %v, want the rollup columns: %v", header, tt.rollupCols)
+			}
+			for i, want := range tt.want {
+				if got := [2]string{records[i+1][res], records[i+1][agg]}; got != want {
+					t.Errorf("record %d resolution and aggregate = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteNDJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, NDJSON, []model.ContainerSeries{series("web", "5m", "p95"), series("db", "", "")}); err != nil {
+		t.Fatalf("writing ndjson: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("wrote %d lines, want 4", len(lines))
+	}
+	for i, line := range lines {
+		var row map[string]any
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			t.Fatalf("decoding line %d: %v", i, err)
+		}
+		want := map[string]any{"resolution": "5m", "aggregate": "p95"}
+		if row["container_name"] == "db" {
+			want = map[string]any{"resolution": nil, "aggregate": nil}
+		}
+		for k, v := range want {
+			if row[k] != v {
+				t.Errorf("line %d %s = %v, want %v", i, k, row[k], v)
+			}
+		}
+		if row["memory_usage"] == nil {
+			t.Errorf("line %d is missing the memory usage", i)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		want Format
+	}{
+		{"csv", CSV},
+		{"ndjson", NDJSON},
+		{"jsonl", NDJSON},
+		{"parquet", Parquet},
+	}
+	for _, tt := range tests {
+		if got, err := ParseFormat(tt.name); err != nil || got != tt.want {
+			t.Errorf("ParseFormat(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+	if _, err := ParseFormat("xml"); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("ParseFormat(xml) error = %v, want %v", err, ErrUnknownFormat)
+	}
+}
+
+func TestWriteDeviceColumns(t *testing.T) {
+	web := series("web", "", "")
+	web.Interfaces = []string{"eth0"}
+	web.Devices = []string{"8:0"}
+	web.Cores = 2
+	web.Datapoints[0].Networks = map[string]model.NetworkDatapoint{"eth0": {RxBytes: 1000}}
+	web.Datapoints[0].BlockIO = map[string]model.BlockIODatapoint{"8:0": {WriteIOPS: 3}}
+	web.Datapoints[0].CPUPerCore = []float64{40, 10}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, NDJSON, []model.ContainerSeries{web}); err != nil {
+		t.Fatalf("writing ndjson: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	rows := make([]map[string]any, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &rows[i]); err != nil {
+			t.Fatalf("decoding line %d: %v", i, err)
+		}
+	}
+	want := map[string]any{
+		"network_eth0_rx_bytes": 1000.0,
+		"blkio_8:0_write_iops":  3.0,
+		"cpu_0_percentage":      40.0,
+		"cpu_1_percentage":      10.0,
+		"network_eth0_tx_bytes": 0.0,
+		"blkio_8:0_read_bytes":  0.0,
+	}
+	for k, v := range want {
+		if rows[0][k] != v {
+			t.Errorf("first row %s = %v, want %v", k, rows[0][k], v)
+		}
+		// the second datapoint has no device datapoints
+		if v, ok := rows[1][k]; ok {
+			t.Errorf("second row %s = %v, want it unset", k, v)
+		}
+	}
+}
+
+func TestWriteParquet(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, Parquet, []model.ContainerSeries{series("web", "1m", "max"), series("db", "", "")}); err != nil {
+		t.Fatalf("writing parquet: %v", err)
+	}
+
+	r := parquet.NewReader(bytes.NewReader(buf.Bytes()))
+	defer r.Close()
+	if n := r.NumRows(); n != 4 {
+		t.Fatalf("wrote %d rows, want 4", n)
+	}
+	for i := 0; i < 4; i++ {
+		row := make(map[string]any)
+		if err := r.Read(&row); err != nil {
+			t.Fatalf("reading row %d: %v", i, err)
+		}
+		if row["memory_usage"] != float64(100*(i%2+1)) {
+			t.Errorf("row %d memory usage = %v, want %d", i, row["memory_usage"], 100*(i%2+1))
+		}
+		want := "1m"
+		if row["container_name"] == "db" {
+			want = ""
+		}
+		if res, _ := row["resolution"].(string); res != want {
+			t.Errorf("row %d resolution = %v, want %q", i, row["resolution"], want)
+		}
+	}
+}
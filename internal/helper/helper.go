@@ -2,6 +2,7 @@ package helper
 
 import (
 	"fmt"
+	"time"
 )
 
 var (
@@ -19,6 +20,17 @@ func Percentage(value uint64, limit uint64) float64 {
 	return (float64(value) / float64(limit)) * float64(100)
 }
 
+/*
+Rate returns the per second rate of a cumulative counter between two
+samples. A counter reset gives a zero rate.
+*/
+func Rate(value uint64, previous uint64, elapsed time.Duration) float64 {
+	if elapsed <= 0 || value < previous {
+		return 0
+	}
+	return float64(value-previous) / elapsed.Seconds()
+}
+
 /*
 FormatMemory formats memory values
 */
@@ -27,7 +39,7 @@ func FormatMemory(value uint64) string {
 }
 
 func unityChooser(value float64, unity int) string {
-	if (value > float64(1024)) && (unity <= len(unityList)) {
+	if (value > float64(1024)) && (unity < len(unityList)-1) {
 		return unityChooser(value/1024.0, unity+1)
 	}
 	return fmt.Sprintf("%01.2f%s", value, unityList[unity])
@@ -0,0 +1,64 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxStatsDocumentSize bounds a stats document, which grows with the
+// number of cores, network interfaces and block devices reported.
+const maxStatsDocumentSize = 4 * 1024 * 1024
+
+var (
+	// ErrInvalidStats reports a stats document that can't be decoded. The
+	// following documents can still be read.
+	ErrInvalidStats = errors.New("invalid stats document")
+)
+
+// StatsDecoder reads newline-delimited stats documents, as streamed by the
+// daemon stats endpoint or recorded by the profiler.
+type StatsDecoder struct {
+	sc   *bufio.Scanner
+	line int
+}
+
+// NewStatsDecoder creates a decoder reading the documents from r.
+func NewStatsDecoder(r io.Reader) *StatsDecoder {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxStatsDocumentSize)
+	return &StatsDecoder{sc: sc}
+}
+
+// Decode decodes the next document into stats, skipping the blank lines.
+// It returns io.EOF once they're all read, and an ErrInvalidStats error
+// for a document that isn't valid JSON.
+func (d *StatsDecoder) Decode(stats *ContainerStats) error {
+	for d.sc.Scan() {
+		d.line++
+		if len(bytes.TrimSpace(d.sc.Bytes())) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(d.sc.Bytes(), stats); err != nil {
+			return fmt.Errorf("%w at line %d: %w", ErrInvalidStats, d.line, err)
+		}
+		return nil
+	}
+	if err := d.sc.Err(); err != nil {
+		return fmt.Errorf("reading stats: %w", err)
+	}
+	return io.EOF
+}
+
+// Bytes returns the raw document last read, valid until the next Decode.
+func (d *StatsDecoder) Bytes() []byte {
+	return d.sc.Bytes()
+}
+
+// Line returns the line number of the document last read.
+func (d *StatsDecoder) Line() int {
+	return d.line
+}
@@ -0,0 +1,110 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// readFixture decodes the recorded stats documents of testdata.
+func readFixture(t *testing.T) []ContainerStats {
+	t.Helper()
+	f, err := os.Open("testdata/stats.ndjson")
+	if err != nil {
+		t.Fatalf("opening fixture: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var docs []ContainerStats
+	dec := NewStatsDecoder(f)
+	for {
+		var stats ContainerStats
+		err := dec.Decode(&stats)
+		if errors.Is(err, io.EOF) {
+			return docs
+		}
+		if err != nil {
+			t.Fatalf("decoding fixture: %v", err)
+		}
+		docs = append(docs, stats)
+	}
+}
+
+func TestStatsDecoderFixture(t *testing.T) {
+	docs := readFixture(t)
+	if len(docs) != 10 {
+		t.Fatalf("decoded %d documents, want 10", len(docs))
+	}
+	names := map[string]int{}
+	for _, d := range docs {
+		names[d.Container().Name]++
+	}
+	if names["web"] != 5 || names["db"] != 5 {
+		t.Errorf("documents by container = %v, want 5 web and 5 db", names)
+	}
+}
+
+func TestStatsDecoderSkipsInvalidDocuments(t *testing.T) {
+	in := strings.Join([]string{
+		`{"id":"a","read":"2024-03-01T10:00:01Z"}`,
+		``,
+		`{"id":`,
+		`  `,
+		`{"id":"b","read":"2024-03-01T10:00:02Z"}`,
+	}, "\n")
+	dec := NewStatsDecoder(strings.NewReader(in))
+
+	var ids []string
+	var invalid []int
+	for {
+		var stats ContainerStats
+		err := dec.Decode(&stats)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, ErrInvalidStats) {
+			invalid = append(invalid, dec.Line())
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ids = append(ids, stats.ID)
+	}
+	if strings.Join(ids, ",") != "a,b" {
+		t.Errorf("decoded ids = %v, want [a b]", ids)
+	}
+	if len(invalid) != 1 || invalid[0] != 3 {
+		t.Errorf("invalid lines = %v, want [3]", invalid)
+	}
+}
+
+func TestStatsDecoderLargeDocument(t *testing.T) {
+	// well over the default 64K of bufio.Scanner, as with many interfaces
+	// or block devices
+	var sb strings.Builder
+	sb.WriteString(`{"id":"big","networks":{`)
+	for i := 0; i < 5000; i++ {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, `"veth%05d":{"rx_bytes":1}`, i)
+	}
+	sb.WriteString("}}\n")
+	if sb.Len() < 64*1024 {
+		t.Fatalf("document is %d bytes, want more than 64K", sb.Len())
+	}
+
+	var stats ContainerStats
+	if err := NewStatsDecoder(strings.NewReader(sb.String())).Decode(&stats); err != nil {
+		t.Fatalf("decoding large document: %v", err)
+	}
+	if stats.ID != "big" || len(stats.Networks) != 5000 {
+		t.Errorf("decoded %q with %d networks, want big with 5000", stats.ID, len(stats.Networks))
+	}
+}
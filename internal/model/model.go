@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/eldius/docker-profiler/internal/helper"
+	"strings"
 	"time"
 )
 
@@ -116,12 +117,120 @@ const (
 
 type ContainerStats struct {
 	types.StatsJSON
+	// StartedAt is the start time of the container lifecycle the stats
+	// were collected from. It's not part of the Docker stats payload, the
+	// raw stats recordings add it.
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Container returns the identification of the container the stats belong to.
+func (s ContainerStats) Container() Container {
+	return Container{
+		ID:        s.ID,
+		Name:      strings.TrimLeft(s.Name, "/"),
+		StartedAt: s.StartedAt,
+	}
+}
+
+// ReadAt returns when the daemon read the sample, falling back to now for
+// samples missing it.
+func (s ContainerStats) ReadAt() time.Time {
+	if s.Read.IsZero() {
+		return time.Now()
+	}
+	return s.Read
+}
+
+// BlockIOCounters are the cumulative block I/O counters of a device.
+type BlockIOCounters struct {
+	ReadBytes  uint64
+	WriteBytes uint64
+	ReadOps    uint64
+	WriteOps   uint64
+}
+
+// BlockIO aggregates the blkio entries by device (`major:minor`) and
+// operation.
+func (s ContainerStats) BlockIO() map[string]BlockIOCounters {
+	devices := make(map[string]BlockIOCounters)
+	add := func(entries []types.BlkioStatEntry, read, write func(c *BlockIOCounters, v uint64)) {
+		for _, e := range entries {
+			device := fmt.Sprintf("%d:%d", e.Major, e.Minor)
+			c := devices[device]
+			switch strings.ToLower(e.Op) {
+			case "read":
+				read(&c, e.Value)
+			case "write":
+				write(&c, e.Value)
+			default:
+				continue
+			}
+			devices[device] = c
+		}
+	}
+	add(s.BlkioStats.IoServiceBytesRecursive,
+		func(c *BlockIOCounters, v uint64) { c.ReadBytes += v },
+		func(c *BlockIOCounters, v uint64) { c.WriteBytes += v },
+	)
+	add(s.BlkioStats.IoServicedRecursive,
+		func(c *BlockIOCounters, v uint64) { c.ReadOps += v },
+		func(c *BlockIOCounters, v uint64) { c.WriteOps += v },
+	)
+	return devices
+}
+
+// MemoryWorkingSet returns the memory usage without the inactive page
+// cache, the same way docker CLI does for `docker stats`.
+func (s ContainerStats) MemoryWorkingSet() uint64 {
+	// cgroup v1, or else v2
+	inactive, ok := s.MemoryStats.Stats["total_inactive_file"]
+	if !ok {
+		inactive = s.MemoryStats.Stats["inactive_file"]
+	}
+	if inactive >= s.MemoryStats.Usage {
+		return s.MemoryStats.Usage
+	}
+	return s.MemoryStats.Usage - inactive
+}
+
+// MemoryBreakdown is the memory composition of a container.
+type MemoryBreakdown struct {
+	Anon        uint64
+	File        uint64
+	Shmem       uint64
+	KernelStack uint64
+	Slab        uint64
+}
+
+// MemoryBreakdown returns the memory composition from the cgroup v2 keys,
+// falling back to the cgroup v1 ones when missing (cgroup v1 doesn't
+// report kernel stack and slab).
+func (s ContainerStats) MemoryBreakdown() MemoryBreakdown {
+	stat := func(keys ...string) uint64 {
+		for _, k := range keys {
+			if v, ok := s.MemoryStats.Stats[k]; ok {
+				return v
+			}
+		}
+		return 0
+	}
+	return MemoryBreakdown{
+		Anon:        stat("anon", "total_rss", "rss"),
+		File:        stat("file", "total_cache", "cache"),
+		Shmem:       stat("shmem", "total_shmem"),
+		KernelStack: stat("kernel_stack"),
+		Slab:        stat("slab"),
+	}
 }
 
 func (s ContainerStats) MemoryUsageStr() string {
 	return helper.FormatMemory(s.MemoryStats.Usage)
 }
 
+func (s ContainerStats) MemoryWorkingSetStr() string {
+	return helper.FormatMemory(s.MemoryWorkingSet())
+}
+
 func (s ContainerStats) MemoryLimitStr() string {
 	return fmt.Sprintf("%02.2f", float64(s.MemoryStats.Limit)/float64(1024*1024))
 }
@@ -138,19 +247,257 @@ func (s *ContainerStats) CPUUsagePercentage() float64 {
 	return cpuPercent
 }
 
+// Container identifies a profiled container lifecycle. A restarted
+// container keeps its ID but gets a new StartedAt, so each lifecycle
+// is kept as its own series segment.
+type Container struct {
+	ID        string
+	Name      string
+	StartedAt time.Time
+}
+
+// Segment returns the key identifying the container lifecycle series.
+func (c Container) Segment() string {
+	if c.StartedAt.IsZero() {
+		return c.ID
+	}
+	return c.ID + "@" + c.StartedAt.UTC().Format(time.RFC3339Nano)
+}
+
+// ShortID returns the abbreviated container ID, as shown by docker CLI.
+func (c Container) ShortID() string {
+	if len(c.ID) > 12 {
+		return c.ID[:12]
+	}
+	return c.ID
+}
+
+// ContainerExit describes how a container lifecycle ended.
+type ContainerExit struct {
+	Code      int64
+	OOMKilled bool
+	At        time.Time
+}
+
+// Limits are the resource limits configured for a container.
+type Limits struct {
+	Memory     int64  `json:",omitempty"`
+	MemorySwap int64  `json:",omitempty"`
+	NanoCPUs   int64  `json:",omitempty"`
+	CPUQuota   int64  `json:",omitempty"`
+	CPUPeriod  int64  `json:",omitempty"`
+	CPUShares  int64  `json:",omitempty"`
+	CpusetCpus string `json:",omitempty"`
+	PidsLimit  int64  `json:",omitempty"`
+}
+
+// CPUs returns the CPU limit as a number of CPUs (0 means unlimited).
+func (l Limits) CPUs() float64 {
+	if l.NanoCPUs > 0 {
+		return float64(l.NanoCPUs) / 1e9
+	}
+	if l.CPUQuota > 0 && l.CPUPeriod > 0 {
+		return float64(l.CPUQuota) / float64(l.CPUPeriod)
+	}
+	return 0
+}
+
+// Session describes one profiling run.
+type Session struct {
+	ID        string
+	StartedAt time.Time
+	EndedAt   *time.Time `json:",omitempty"`
+	// Args are the command line arguments the session was started with.
+	Args []string
+	Note string `json:",omitempty"`
+	// Interval is the sampling interval (0 means the daemon stats stream).
+	Interval time.Duration `json:",omitempty"`
+	// Precision is the timestamp precision of the stored datapoints.
+	Precision string `json:",omitempty"`
+	// Storage is the storage backend of the datapoints (tstorage when
+	// empty).
+	Storage string `json:",omitempty"`
+	// Retention is how long the raw datapoints are kept once downsampled,
+	// back from the latest one persisted (0 keeps them).
+	Retention time.Duration `json:",omitempty"`
+	// DownsampledUntil is the time the datapoints are rolled up to.
+	DownsampledUntil *time.Time `json:",omitempty"`
+	// PrunedUntil is the time the raw datapoints are pruned up to, out of
+	// the retention.
+	PrunedUntil *time.Time `json:",omitempty"`
+	Containers  []SessionContainer
+}
+
+// SessionContainer describes a container lifecycle profiled in a session.
+type SessionContainer struct {
+	Container
+	Image       string `json:",omitempty"`
+	ImageDigest string `json:",omitempty"`
+	Limits      Limits
+	// Interfaces are the network interfaces with stored datapoints.
+	Interfaces []string `json:",omitempty"`
+	// Devices are the block devices with stored datapoints.
+	Devices []string `json:",omitempty"`
+	// Cores is the number of cores with per core usage datapoints.
+	Cores int `json:",omitempty"`
+	// Exit is set when the container exit was recorded.
+	Exit *ContainerExit `json:",omitempty"`
+}
+
+// ContainerSeries holds the datapoints collected for one container.
+type ContainerSeries struct {
+	SessionID string
+	SessionContainer
+	// Resolution is the interval of the downsampled datapoints (eg: 1m),
+	// empty for raw ones.
+	Resolution string `json:",omitempty"`
+	// Aggregate is the value the downsampled datapoints hold (eg: max),
+	// empty for raw ones.
+	Aggregate  string `json:",omitempty"`
+	Datapoints []MetricsDatapoint
+}
+
+// CPUUserPercentage returns the CPU percentage spent in user mode since
+// the previous sample.
+func (s *ContainerStats) CPUUserPercentage() float64 {
+	return s.cpuPercentage(s.CPUStats.CPUUsage.UsageInUsermode, s.PreCPUStats.CPUUsage.UsageInUsermode)
+}
+
+// CPUKernelPercentage returns the CPU percentage spent in kernel mode
+// since the previous sample.
+func (s *ContainerStats) CPUKernelPercentage() float64 {
+	return s.cpuPercentage(s.CPUStats.CPUUsage.UsageInKernelmode, s.PreCPUStats.CPUUsage.UsageInKernelmode)
+}
+
+// CPUPerCorePercentage returns the usage percentage of each core since
+// the previous sample. It's nil when the daemon doesn't report per core
+// usage (cgroup v2).
+func (s *ContainerStats) CPUPerCorePercentage() []float64 {
+	cores := s.CPUStats.CPUUsage.PercpuUsage
+	prevCores := s.PreCPUStats.CPUUsage.PercpuUsage
+	if len(cores) == 0 {
+		return nil
+	}
+	numCPUs := float64(len(cores))
+	systemDelta := float64(s.CPUStats.SystemUsage) - float64(s.PreCPUStats.SystemUsage)
+	percentages := make([]float64, len(cores))
+	for i, v := range cores {
+		if i >= len(prevCores) || systemDelta <= 0.0 {
+			continue
+		}
+		if delta := float64(v) - float64(prevCores[i]); delta > 0.0 {
+			percentages[i] = (delta / (systemDelta / numCPUs)) * 100.0
+		}
+	}
+	return percentages
+}
+
+func (s *ContainerStats) cpuPercentage(usage, prevUsage uint64) float64 {
+	cpuPercent := 0.0
+	numCPUs := s.CPUStats.OnlineCPUs
+	cpuDelta := float64(usage) - float64(prevUsage)
+	systemDelta := float64(s.CPUStats.SystemUsage) - float64(s.PreCPUStats.SystemUsage)
+
+	if cpuDelta > 0.0 && systemDelta > 0.0 {
+		cpuPercent = (cpuDelta / systemDelta) * float64(numCPUs) * 100.0
+	}
+	return cpuPercent
+}
+
+// CPUThrottledPercentage returns the percentage of CPU periods throttled
+// since the previous sample.
+func (s *ContainerStats) CPUThrottledPercentage() float64 {
+	periods := s.CPUStats.ThrottlingData.Periods
+	prevPeriods := s.PreCPUStats.ThrottlingData.Periods
+	throttled := s.CPUStats.ThrottlingData.ThrottledPeriods
+	prevThrottled := s.PreCPUStats.ThrottlingData.ThrottledPeriods
+	if periods <= prevPeriods || throttled < prevThrottled {
+		return 0
+	}
+	return helper.Percentage(throttled-prevThrottled, periods-prevPeriods)
+}
+
 type MetricsDatapoint struct {
-	Timestamp      time.Time
-	MemoryUsage    float64
-	MemoryLimit    float64
-	CPUOnlineCount float64
-	CPUUsage       float64
-	CPUPercentage  float64
+	Timestamp   time.Time
+	MemoryUsage float64
+	MemoryLimit float64
+	// MemoryWorkingSet is the usage without the inactive page cache.
+	MemoryWorkingSet float64
+	// MemoryAnon, MemoryFile, MemoryShmem, MemoryKernelStack and
+	// MemorySlab are the memory composition.
+	MemoryAnon        float64
+	MemoryFile        float64
+	MemoryShmem       float64
+	MemoryKernelStack float64
+	MemorySlab        float64
+	CPUOnlineCount    float64
+	CPUUsage          float64
+	CPUPercentage     float64
+	// CPUUserPercentage and CPUKernelPercentage split CPUPercentage in
+	// user and kernel mode.
+	CPUUserPercentage   float64
+	CPUKernelPercentage float64
+	// CPUPerCore is the usage percentage of each core, when reported.
+	CPUPerCore []float64
+	// PidsCurrent is the number of pids in the cgroup and PidsLimit its
+	// hard limit (0 means no limit).
+	PidsCurrent float64
+	PidsLimit   float64
+	// ThrottlingPeriods, ThrottledPeriods and ThrottledTime (nanoseconds)
+	// are cumulative cgroup counters.
+	ThrottlingPeriods float64
+	ThrottledPeriods  float64
+	ThrottledTime     float64
+	// ThrottledPercentage is the percentage of periods throttled since
+	// the previous sample.
+	ThrottledPercentage float64
+	// Networks holds the network datapoints by interface name.
+	Networks map[string]NetworkDatapoint
+	// BlockIO holds the block I/O datapoints by device (`major:minor`).
+	BlockIO map[string]BlockIODatapoint
+	// Missing lists the metrics without a stored value at the timestamp,
+	// whose previous value got carried forward.
+	Missing []string
+}
+
+// NetworkDatapoint holds the cumulative counters of a network interface
+// and the per second rates derived from the previous sample.
+type NetworkDatapoint struct {
+	RxBytes       float64
+	RxPackets     float64
+	RxErrors      float64
+	RxDropped     float64
+	TxBytes       float64
+	TxPackets     float64
+	TxErrors      float64
+	TxDropped     float64
+	RxBytesRate   float64
+	RxPacketsRate float64
+	TxBytesRate   float64
+	TxPacketsRate float64
+}
+
+// BlockIODatapoint holds the cumulative block I/O counters of a device
+// and the per second rates derived from the previous sample.
+type BlockIODatapoint struct {
+	ReadBytes      float64
+	WriteBytes     float64
+	ReadOps        float64
+	WriteOps       float64
+	ReadBytesRate  float64
+	WriteBytesRate float64
+	ReadIOPS       float64
+	WriteIOPS      float64
 }
 
 func (m MetricsDatapoint) MemoryUsageStr() string {
 	return helper.FormatMemory(uint64(m.MemoryUsage))
 }
 
+func (m MetricsDatapoint) MemoryWorkingSetStr() string {
+	return helper.FormatMemory(uint64(m.MemoryWorkingSet))
+}
+
 func (m MetricsDatapoint) MemoryLimitStr() string {
 	return helper.FormatMemory(uint64(m.MemoryLimit))
 }
@@ -0,0 +1,195 @@
+package model
+
+import (
+	"github.com/docker/docker/api/types"
+	"math"
+	"testing"
+	"time"
+)
+
+const mib = 1024 * 1024
+
+// fixtureStats returns the second document recorded for the container.
+func fixtureStats(t *testing.T, name string) ContainerStats {
+	t.Helper()
+	var seen int
+	for _, d := range readFixture(t) {
+		if d.Container().Name != name {
+			continue
+		}
+		if seen++; seen == 2 {
+			return d
+		}
+	}
+	t.Fatalf("no second document of '%s' in the fixture", name)
+	return ContainerStats{}
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestCPUPercentages(t *testing.T) {
+	s := fixtureStats(t, "web")
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"total", s.CPUUsagePercentage(), 50},
+		{"user", s.CPUUserPercentage(), 30},
+		{"kernel", s.CPUKernelPercentage(), 20},
+		{"throttled", s.CPUThrottledPercentage(), 10},
+	}
+	for _, tt := range tests {
+		if !approxEqual(tt.got, tt.want) {
+			t.Errorf("%s cpu = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	cores := s.CPUPerCorePercentage()
+	if len(cores) != 2 || !approxEqual(cores[0], 30) || !approxEqual(cores[1], 20) {
+		t.Errorf("per core cpu = %v, want [30 20]", cores)
+	}
+	db := fixtureStats(t, "db")
+	if cores := db.CPUPerCorePercentage(); cores != nil {
+		t.Errorf("per core cpu without percpu usage = %v, want nil", cores)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	tests := []struct {
+		name       string
+		workingSet uint64
+		breakdown  MemoryBreakdown
+	}{
+		{
+			name:       "web",
+			workingSet: 80 * mib,
+			breakdown:  MemoryBreakdown{Anon: 60 * mib, File: 30 * mib, Shmem: 5 * mib, KernelStack: mib, Slab: 4 * mib},
+		},
+		{
+			// cgroup v1 keys
+			name:       "db",
+			workingSet: 180 * mib,
+			breakdown:  MemoryBreakdown{Anon: 150 * mib, File: 40 * mib, Shmem: 2 * mib},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := fixtureStats(t, tt.name)
+			if got := s.MemoryWorkingSet(); got != tt.workingSet {
+				t.Errorf("working set = %d, want %d", got, tt.workingSet)
+			}
+			if got := s.MemoryBreakdown(); got != tt.breakdown {
+				t.Errorf("breakdown = %+v, want %+v", got, tt.breakdown)
+			}
+		})
+	}
+}
+
+func TestMemoryWorkingSet(t *testing.T) {
+	tests := []struct {
+		name  string
+		usage uint64
+		stats map[string]uint64
+		want  uint64
+	}{
+		{"cgroup v1", 100, map[string]uint64{"total_inactive_file": 30, "inactive_file": 10}, 70},
+		{"cgroup v2", 100, map[string]uint64{"inactive_file": 30}, 70},
+		{"no inactive page cache", 100, nil, 100},
+		// the v2 key isn't a fallback for the v1 one
+		{"cgroup v1 inactive over usage", 100, map[string]uint64{"total_inactive_file": 150, "inactive_file": 10}, 100},
+		{"cgroup v1 inactive at usage", 100, map[string]uint64{"total_inactive_file": 100}, 100},
+		{"cgroup v2 inactive over usage", 100, map[string]uint64{"inactive_file": 150}, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s ContainerStats
+			s.MemoryStats.Usage = tt.usage
+			s.MemoryStats.Stats = tt.stats
+			if got := s.MemoryWorkingSet(); got != tt.want {
+				t.Errorf("working set = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlockIO(t *testing.T) {
+	got := fixtureStats(t, "web").BlockIO()
+	want := BlockIOCounters{ReadBytes: 8192, WriteBytes: 16384, ReadOps: 2, WriteOps: 4}
+	if len(got) != 1 || got["8:0"] != want {
+		t.Errorf("block io = %+v, want 8:0 %+v", got, want)
+	}
+	if got := fixtureStats(t, "db").BlockIO(); len(got) != 0 {
+		t.Errorf("block io without entries = %+v, want none", got)
+	}
+}
+
+func TestBlockIODevices(t *testing.T) {
+	var s ContainerStats
+	// cgroup v1 lists Sync/Async/Total next to Read/Write, v2 lowercases them
+	s.BlkioStats.IoServiceBytesRecursive = []types.BlkioStatEntry{
+		{Major: 8, Minor: 0, Op: "Read", Value: 100},
+		{Major: 8, Minor: 0, Op: "Write", Value: 200},
+		{Major: 8, Minor: 0, Op: "Total", Value: 300},
+		{Major: 8, Minor: 16, Op: "read", Value: 10},
+		{Major: 8, Minor: 16, Op: "write", Value: 20},
+	}
+	s.BlkioStats.IoServicedRecursive = []types.BlkioStatEntry{
+		{Major: 8, Minor: 0, Op: "Read", Value: 1},
+		{Major: 8, Minor: 0, Op: "Write", Value: 2},
+		{Major: 8, Minor: 0, Op: "Sync", Value: 3},
+	}
+	got := s.BlockIO()
+	want := map[string]BlockIOCounters{
+		"8:0":  {ReadBytes: 100, WriteBytes: 200, ReadOps: 1, WriteOps: 2},
+		"8:16": {ReadBytes: 10, WriteBytes: 20},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("block io = %+v, want %+v", got, want)
+	}
+	for device, c := range want {
+		if got[device] != c {
+			t.Errorf("%s = %+v, want %+v", device, got[device], c)
+		}
+	}
+}
+
+func TestCPUThrottledPercentage(t *testing.T) {
+	tests := []struct {
+		name                     string
+		periods, prevPeriods     uint64
+		throttled, prevThrottled uint64
+		want                     float64
+	}{
+		{"throttled", 200, 100, 30, 5, 25},
+		{"never throttled", 200, 100, 0, 0, 0},
+		{"no new period", 100, 100, 5, 5, 0},
+		// the counters restart with the container
+		{"counters reset", 10, 100, 1, 5, 0},
+	}
+	for _, tt := range tests {
+		var s ContainerStats
+		s.CPUStats.ThrottlingData.Periods = tt.periods
+		s.PreCPUStats.ThrottlingData.Periods = tt.prevPeriods
+		s.CPUStats.ThrottlingData.ThrottledPeriods = tt.throttled
+		s.PreCPUStats.ThrottlingData.ThrottledPeriods = tt.prevThrottled
+		if got := s.CPUThrottledPercentage(); !approxEqual(got, tt.want) {
+			t.Errorf("%s: throttled = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadAt(t *testing.T) {
+	s := fixtureStats(t, "web")
+	if !s.ReadAt().Equal(s.Read) {
+		t.Errorf("read at %s, want the daemon read time %s", s.ReadAt(), s.Read)
+	}
+
+	before := time.Now()
+	s.Read = time.Time{}
+	if at := s.ReadAt(); at.Before(before) || at.After(time.Now()) {
+		t.Errorf("read at %s without a daemon read time, want now", at)
+	}
+}
@@ -0,0 +1,450 @@
+package otlpexport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/eldius/docker-profiler/internal/docker"
+	"github.com/eldius/docker-profiler/internal/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scopeName       = "github.com/eldius/docker-profiler"
+	serviceName     = "docker-profiler"
+	defaultInterval = 10 * time.Second
+)
+
+const (
+	// interfaceKey is the network interface attribute, which the semantic
+	// conventions in use don't define yet.
+	interfaceKey = attribute.Key("network.interface.name")
+	deviceKey    = attribute.Key("device")
+)
+
+// Protocol is the OTLP transport.
+type Protocol string
+
+const (
+	GRPC Protocol = "grpc"
+	HTTP Protocol = "http"
+)
+
+// ParseProtocol returns the protocol named by s (grpc or http).
+func ParseProtocol(s string) (Protocol, error) {
+	switch p := Protocol(strings.ToLower(s)); p {
+	case GRPC, HTTP:
+		return p, nil
+	case "http/protobuf":
+		return HTTP, nil
+	}
+	return "", fmt.Errorf("unknown OTLP protocol '%s' (expected grpc or http)", s)
+}
+
+// Options configures the OTLP connection.
+type Options struct {
+	Protocol Protocol
+	// Endpoint is the collector address, as host:port or as URL (the
+	// http scheme meaning no TLS). When empty the OTEL_EXPORTER_OTLP_*
+	// environment variables apply, defaulting to localhost.
+	Endpoint string
+	// Insecure disables TLS.
+	Insecure bool
+	// Interval is the export interval (10s when not set).
+	Interval time.Duration
+}
+
+// Exporter publishes the stats samples of every profiled container as
+// OTel metrics over OTLP. Every container lifecycle gets its own meter
+// provider, so its metrics carry the container resource attributes, and
+// is flushed once the lifecycle isn't profiled anymore.
+type Exporter struct {
+	exp      sdkmetric.Exporter
+	interval time.Duration
+
+	mu         sync.Mutex
+	containers map[string]*container
+	// wg tracks the providers being flushed and shut down.
+	wg sync.WaitGroup
+}
+
+// container holds the meter provider and the latest sample of a
+// container lifecycle.
+type container struct {
+	provider *sdkmetric.MeterProvider
+
+	mu    sync.Mutex
+	stats *model.ContainerStats
+}
+
+var _ docker.Sink = (*Exporter)(nil)
+
+// New creates an exporter connecting to the collector.
+func New(ctx context.Context, opts Options) (*Exporter, error) {
+	exp, err := newExporter(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP %s exporter: %w", opts.Protocol, err)
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	return &Exporter{
+		exp:        exp,
+		interval:   interval,
+		containers: make(map[string]*container),
+	}, nil
+}
+
+func newExporter(ctx context.Context, opts Options) (sdkmetric.Exporter, error) {
+	switch opts.Protocol {
+	case GRPC, "":
+		var o []otlpmetricgrpc.Option
+		if strings.Contains(opts.Endpoint, "://") {
+			o = append(o, otlpmetricgrpc.WithEndpointURL(opts.Endpoint))
+		} else if opts.Endpoint != "" {
+			o = append(o, otlpmetricgrpc.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			o = append(o, otlpmetricgrpc.WithInsecure())
+		}
+		return otlpmetricgrpc.New(ctx, o...)
+	case HTTP:
+		var o []otlpmetrichttp.Option
+		if strings.Contains(opts.Endpoint, "://") {
+			o = append(o, otlpmetrichttp.WithEndpointURL(opts.Endpoint))
+		} else if opts.Endpoint != "" {
+			o = append(o, otlpmetrichttp.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			o = append(o, otlpmetrichttp.WithInsecure())
+		}
+		return otlpmetrichttp.New(ctx, o...)
+	}
+	return nil, fmt.Errorf("unknown protocol '%s'", opts.Protocol)
+}
+
+func (e *Exporter) Observe(sc model.SessionContainer, stats model.ContainerStats) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ct, ok := e.containers[sc.Segment()]
+	if !ok {
+		var err error
+		if ct, err = e.track(sc); err != nil {
+			return err
+		}
+		e.containers[sc.Segment()] = ct
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.stats = &stats
+	return nil
+}
+
+// Forget flushes the last sample of the container lifecycle and stops
+// exporting it, in the background.
+func (e *Exporter) Forget(c model.Container) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ct, ok := e.containers[c.Segment()]
+	if !ok {
+		return
+	}
+	delete(e.containers, c.Segment())
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		if err := ct.provider.Shutdown(context.Background()); err != nil {
+			fmt.Printf("failed to flush metrics of '%s': %v\n", c.Name, err)
+		}
+	}()
+}
+
+// Close flushes the pending samples and closes the collector connection.
+func (e *Exporter) Close(ctx context.Context) error {
+	e.mu.Lock()
+	var errs []error
+	for segment, ct := range e.containers {
+		if err := ct.provider.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+		delete(e.containers, segment)
+	}
+	e.mu.Unlock()
+
+	e.wg.Wait()
+	errs = append(errs, e.exp.Shutdown(ctx))
+	return errors.Join(errs...)
+}
+
+// track creates the meter provider of the container lifecycle, observing
+// its latest sample on every export.
+func (e *Exporter) track(sc model.SessionContainer) (*container, error) {
+	res, err := resource.New(context.Background(),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(containerAttributes(sc)...),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating resource of '%s': %w", sc.Name, err)
+	}
+	ct := &container{
+		provider: sdkmetric.NewMeterProvider(
+			sdkmetric.WithResource(res),
+			sdkmetric.WithReader(sdkmetric.NewPeriodicReader(sharedExporter{e.exp}, sdkmetric.WithInterval(e.interval))),
+		),
+	}
+
+	meter := ct.provider.Meter(scopeName)
+	observables := make([]metric.Observable, len(instruments))
+	for i, in := range instruments {
+		var err error
+		if in.counter {
+			observables[i], err = meter.Float64ObservableCounter(in.name, metric.WithUnit(in.unit), metric.WithDescription(in.description))
+		} else {
+			observables[i], err = meter.Float64ObservableGauge(in.name, metric.WithUnit(in.unit), metric.WithDescription(in.description))
+		}
+		if err != nil {
+			_ = ct.provider.Shutdown(context.Background())
+			return nil, fmt.Errorf("creating instrument '%s': %w", in.name, err)
+		}
+	}
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		stats := ct.latest()
+		if stats == nil {
+			return nil
+		}
+		for i, in := range instruments {
+			obs := observables[i].(metric.Float64Observable)
+			in.observe(stats, func(v float64, attrs ...attribute.KeyValue) {
+				o.ObserveFloat64(obs, v, metric.WithAttributes(attrs...))
+			})
+		}
+		return nil
+	}, observables...)
+	if err != nil {
+		_ = ct.provider.Shutdown(context.Background())
+		return nil, fmt.Errorf("registering callback of '%s': %w", sc.Name, err)
+	}
+	return ct, nil
+}
+
+func (ct *container) latest() *model.ContainerStats {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if ct.stats == nil {
+		return nil
+	}
+	stats := *ct.stats
+	return &stats
+}
+
+// containerAttributes returns the resource attributes of the container.
+func containerAttributes(sc model.SessionContainer) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(serviceName),
+		semconv.ContainerID(sc.ID),
+		semconv.ContainerName(sc.Name),
+	}
+	if sc.Image != "" {
+		name, tag := splitImage(sc.Image)
+		attrs = append(attrs, semconv.ContainerImageName(name))
+		if tag != "" {
+			attrs = append(attrs, semconv.ContainerImageTags(tag))
+		}
+	}
+	if sc.ImageDigest != "" {
+		if strings.Contains(sc.ImageDigest, "@") {
+			attrs = append(attrs, semconv.ContainerImageRepoDigests(sc.ImageDigest))
+		} else {
+			attrs = append(attrs, semconv.ContainerImageID(sc.ImageDigest))
+		}
+	}
+	return attrs
+}
+
+// splitImage splits the image reference into its name and tag, ignoring
+// the digest.
+func splitImage(ref string) (string, string) {
+	ref, _, _ = strings.Cut(ref, "@")
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// sharedExporter keeps the collector connection open when the reader of
+// a container lifecycle shuts down, as it's shared by all of them.
+type sharedExporter struct {
+	sdkmetric.Exporter
+}
+
+func (sharedExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// instrument is a metric observed from the latest sample of a container.
+type instrument struct {
+	name        string
+	unit        string
+	description string
+	counter     bool
+	observe     func(s *model.ContainerStats, record func(v float64, attrs ...attribute.KeyValue))
+}
+
+var instruments = []instrument{
+	gauge("container.memory.usage", "By", "Memory usage, page cache included.", func(s *model.ContainerStats) float64 {
+		return float64(s.MemoryStats.Usage)
+	}),
+	gauge("container.memory.limit", "By", "Memory limit.", func(s *model.ContainerStats) float64 {
+		return float64(s.MemoryStats.Limit)
+	}),
+	gauge("container.memory.working_set", "By", "Memory usage without the inactive page cache.", func(s *model.ContainerStats) float64 {
+		return float64(s.MemoryWorkingSet())
+	}),
+	{
+		name:        "container.memory.composition",
+		unit:        "By",
+		description: "Memory usage by kind (anon, file, shmem, kernel_stack, slab).",
+		observe: func(s *model.ContainerStats, record func(float64, ...attribute.KeyValue)) {
+			mem := s.MemoryBreakdown()
+			for kind, v := range map[string]uint64{
+				"anon":         mem.Anon,
+				"file":         mem.File,
+				"shmem":        mem.Shmem,
+				"kernel_stack": mem.KernelStack,
+				"slab":         mem.Slab,
+			} {
+				record(float64(v), attribute.String("kind", kind))
+			}
+		},
+	},
+	gauge("container.cpu.usage", "%", "CPU usage percentage since the previous sample.", func(s *model.ContainerStats) float64 {
+		return s.CPUUsagePercentage()
+	}),
+	gauge("container.cpu.user", "%", "CPU usage percentage in user mode since the previous sample.", func(s *model.ContainerStats) float64 {
+		return s.CPUUserPercentage()
+	}),
+	gauge("container.cpu.kernel", "%", "CPU usage percentage in kernel mode since the previous sample.", func(s *model.ContainerStats) float64 {
+		return s.CPUKernelPercentage()
+	}),
+	{
+		name:        "container.cpu.core.usage",
+		unit:        "%",
+		description: "CPU usage percentage of a core since the previous sample.",
+		observe: func(s *model.ContainerStats, record func(float64, ...attribute.KeyValue)) {
+			for core, v := range s.CPUPerCorePercentage() {
+				record(v, attribute.String("cpu", strconv.Itoa(core)))
+			}
+		},
+	},
+	gauge("container.cpu.online", "{cpu}", "Number of online CPUs.", func(s *model.ContainerStats) float64 {
+		return float64(s.CPUStats.OnlineCPUs)
+	}),
+	counter("container.cpu.time", "s", "Cumulative CPU time consumed.", func(s *model.ContainerStats) float64 {
+		return float64(s.CPUStats.CPUUsage.TotalUsage) / 1e9
+	}),
+	gauge("container.cpu.throttled", "%", "Percentage of periods throttled since the previous sample.", func(s *model.ContainerStats) float64 {
+		return s.CPUThrottledPercentage()
+	}),
+	counter("container.cpu.throttling.periods", "{period}", "Cumulative CPU enforcement periods.", func(s *model.ContainerStats) float64 {
+		return float64(s.CPUStats.ThrottlingData.Periods)
+	}),
+	counter("container.cpu.throttled.periods", "{period}", "Cumulative CPU enforcement periods throttled.", func(s *model.ContainerStats) float64 {
+		return float64(s.CPUStats.ThrottlingData.ThrottledPeriods)
+	}),
+	counter("container.cpu.throttled.time", "s", "Cumulative time throttled.", func(s *model.ContainerStats) float64 {
+		return float64(s.CPUStats.ThrottlingData.ThrottledTime) / 1e9
+	}),
+	gauge("container.pids.current", "{pid}", "Number of pids in the container cgroup.", func(s *model.ContainerStats) float64 {
+		return float64(s.PidsStats.Current)
+	}),
+	gauge("container.pids.limit", "{pid}", "Pids limit (0 means no limit).", func(s *model.ContainerStats) float64 {
+		return float64(s.PidsStats.Limit)
+	}),
+	network("container.network.io", "By", "Cumulative bytes transferred.", func(n types.NetworkStats) (uint64, uint64) {
+		return n.RxBytes, n.TxBytes
+	}),
+	network("container.network.packets", "{packet}", "Cumulative packets transferred.", func(n types.NetworkStats) (uint64, uint64) {
+		return n.RxPackets, n.TxPackets
+	}),
+	network("container.network.errors", "{error}", "Cumulative transfer errors.", func(n types.NetworkStats) (uint64, uint64) {
+		return n.RxErrors, n.TxErrors
+	}),
+	network("container.network.dropped", "{packet}", "Cumulative packets dropped.", func(n types.NetworkStats) (uint64, uint64) {
+		return n.RxDropped, n.TxDropped
+	}),
+	blockIO("container.blockio.io", "By", "Cumulative bytes transferred.", func(b model.BlockIOCounters) (uint64, uint64) {
+		return b.ReadBytes, b.WriteBytes
+	}),
+	blockIO("container.blockio.operations", "{operation}", "Cumulative operations.", func(b model.BlockIOCounters) (uint64, uint64) {
+		return b.ReadOps, b.WriteOps
+	}),
+}
+
+func gauge(name, unit, description string, value func(s *model.ContainerStats) float64) instrument {
+	return instrument{
+		name:        name,
+		unit:        unit,
+		description: description,
+		observe: func(s *model.ContainerStats, record func(float64, ...attribute.KeyValue)) {
+			record(value(s))
+		},
+	}
+}
+
+func counter(name, unit, description string, value func(s *model.ContainerStats) float64) instrument {
+	in := gauge(name, unit, description, value)
+	in.counter = true
+	return in
+}
+
+// network is a counter by interface and direction.
+func network(name, unit, description string, value func(n types.NetworkStats) (rx, tx uint64)) instrument {
+	return instrument{
+		name:        name,
+		unit:        unit,
+		description: description,
+		counter:     true,
+		observe: func(s *model.ContainerStats, record func(float64, ...attribute.KeyValue)) {
+			for iface, n := range s.Networks {
+				rx, tx := value(n)
+				record(float64(rx), interfaceKey.String(iface), semconv.NetworkIoDirectionReceive)
+				record(float64(tx), interfaceKey.String(iface), semconv.NetworkIoDirectionTransmit)
+			}
+		},
+	}
+}
+
+// blockIO is a counter by device and direction.
+func blockIO(name, unit, description string, value func(b model.BlockIOCounters) (read, write uint64)) instrument {
+	return instrument{
+		name:        name,
+		unit:        unit,
+		description: description,
+		counter:     true,
+		observe: func(s *model.ContainerStats, record func(float64, ...attribute.KeyValue)) {
+			for device, b := range s.BlockIO() {
+				read, write := value(b)
+				record(float64(read), deviceKey.String(device), semconv.DiskIoDirectionRead)
+				record(float64(write), deviceKey.String(device), semconv.DiskIoDirectionWrite)
+			}
+		},
+	}
+}
@@ -0,0 +1,116 @@
+package otlpexport_test
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/eldius/docker-profiler/internal/model"
+	"github.com/eldius/docker-profiler/internal/otlpexport"
+	"github.com/eldius/docker-profiler/internal/otlpexport/otlptest"
+	"testing"
+	"time"
+)
+
+func stats() model.ContainerStats {
+	var s model.ContainerStats
+	s.Read = time.Date(2024, 3, 1, 10, 0, 1, 0, time.UTC)
+	s.PreRead = s.Read.Add(-time.Second)
+	s.MemoryStats.Usage = 1000
+	s.CPUStats.OnlineCPUs = 1
+	s.CPUStats.SystemUsage = 2000
+	s.CPUStats.CPUUsage.TotalUsage = 600
+	s.PreCPUStats.SystemUsage = 1000
+	s.PreCPUStats.CPUUsage.TotalUsage = 300
+	s.Networks = map[string]types.NetworkStats{"eth0": {RxBytes: 10, TxBytes: 5}}
+	return s
+}
+
+func TestExport(t *testing.T) {
+	col, err := otlptest.NewCollector()
+	if err != nil {
+		t.Fatalf("starting collector: %v", err)
+	}
+	defer col.Close()
+
+	tests := []struct {
+		name string
+		opts otlpexport.Options
+	}{
+		{"grpc", otlpexport.Options{Protocol: otlpexport.GRPC, Endpoint: col.GRPCEndpoint(), Insecure: true}},
+		{"http", otlpexport.Options{Protocol: otlpexport.HTTP, Endpoint: col.HTTPEndpoint()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			e, err := otlpexport.New(ctx, tt.opts)
+			if err != nil {
+				t.Fatalf("creating exporter: %v", err)
+			}
+
+			sc := model.SessionContainer{
+				Container: model.Container{
+					ID:        tt.name + "-aaa111",
+					Name:      "web",
+					StartedAt: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+				},
+				Image: "alpine:3.19",
+			}
+			if err := e.Observe(sc, stats()); err != nil {
+				t.Fatalf("observing: %v", err)
+			}
+			// forgetting the container flushes its last sample
+			e.Forget(sc.Container)
+			if err := e.Close(ctx); err != nil {
+				t.Fatalf("closing exporter: %v", err)
+			}
+
+			attrs, names := received(col, sc.ID)
+			if attrs == nil {
+				t.Fatalf("collector received no metrics of %s", sc.ID)
+			}
+			for key, want := range map[string]string{
+				"service.name":         "docker-profiler",
+				"container.id":         sc.ID,
+				"container.name":       "web",
+				"container.image.name": "alpine",
+			} {
+				if got := attrs[key]; got != want {
+					t.Errorf("resource attribute %s = %q, want %q", key, got, want)
+				}
+			}
+			for _, name := range []string{
+				"container.memory.usage",
+				"container.cpu.usage",
+				"container.cpu.time",
+				"container.network.io",
+			} {
+				if !names[name] {
+					t.Errorf("collector didn't receive %s", name)
+				}
+			}
+		})
+	}
+}
+
+// received returns the resource attributes and the metric names the
+// collector received for the container.
+func received(col *otlptest.Collector, id string) (map[string]string, map[string]bool) {
+	var attrs map[string]string
+	names := map[string]bool{}
+	for _, rm := range col.ResourceMetrics() {
+		ra := map[string]string{}
+		for _, a := range rm.GetResource().GetAttributes() {
+			ra[a.GetKey()] = a.GetValue().GetStringValue()
+		}
+		if ra["container.id"] != id {
+			continue
+		}
+		attrs = ra
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				names[m.GetName()] = true
+			}
+		}
+	}
+	return attrs, names
+}
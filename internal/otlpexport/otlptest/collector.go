@@ -0,0 +1,121 @@
+package otlptest
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// Collector is a stand-in for an OpenTelemetry collector, receiving OTLP
+// metrics over gRPC and HTTP and keeping them in memory, for exercising
+// the exporter without a collector running.
+type Collector struct {
+	collectorpb.UnimplementedMetricsServiceServer
+
+	mu       sync.Mutex
+	received []*metricspb.ResourceMetrics
+
+	lis  net.Listener
+	grpc *grpc.Server
+	http *httptest.Server
+}
+
+// NewCollector starts the stand-in, listening on loopback addresses.
+func NewCollector() (*Collector, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("listening for gRPC: %w", err)
+	}
+	c := &Collector{
+		lis:  lis,
+		grpc: grpc.NewServer(),
+	}
+	collectorpb.RegisterMetricsServiceServer(c.grpc, c)
+	go func() {
+		_ = c.grpc.Serve(lis)
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/metrics", c.serveHTTP)
+	c.http = httptest.NewServer(mux)
+	return c, nil
+}
+
+// GRPCEndpoint returns the host:port of the OTLP/gRPC receiver.
+func (c *Collector) GRPCEndpoint() string {
+	return c.lis.Addr().String()
+}
+
+// HTTPEndpoint returns the URL of the OTLP/HTTP receiver.
+func (c *Collector) HTTPEndpoint() string {
+	return c.http.URL
+}
+
+// ResourceMetrics returns the metrics received so far, by resource.
+func (c *Collector) ResourceMetrics() []*metricspb.ResourceMetrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]*metricspb.ResourceMetrics(nil), c.received...)
+}
+
+// Close stops both receivers.
+func (c *Collector) Close() {
+	c.grpc.Stop()
+	c.http.Close()
+}
+
+func (c *Collector) Export(_ context.Context, req *collectorpb.ExportMetricsServiceRequest) (*collectorpb.ExportMetricsServiceResponse, error) {
+	c.receive(req)
+	return &collectorpb.ExportMetricsServiceResponse{}, nil
+}
+
+func (c *Collector) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer func() {
+			_ = gz.Close()
+		}()
+		body = gz
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req collectorpb.ExportMetricsServiceRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.receive(&req)
+
+	resp, err := proto.Marshal(&collectorpb.ExportMetricsServiceResponse{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(resp)
+}
+
+func (c *Collector) receive(req *collectorpb.ExportMetricsServiceRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.received = append(c.received, req.GetResourceMetrics()...)
+}
@@ -0,0 +1,395 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"github.com/eldius/docker-profiler/internal/model"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Resolution is the interval of the listed datapoints.
+type Resolution string
+
+const (
+	// Auto picks the finest resolution keeping the series under
+	// maxListPoints datapoints.
+	Auto Resolution = "auto"
+	// Raw lists the datapoints as collected.
+	Raw Resolution = "raw"
+	// Minute lists the datapoints rolled up by minute.
+	Minute Resolution = "1m"
+	// FiveMinutes lists the datapoints rolled up by 5 minutes.
+	FiveMinutes Resolution = "5m"
+)
+
+// Aggregate is the value of the datapoints rolled up into a downsampled
+// one.
+type Aggregate string
+
+const (
+	Avg Aggregate = "avg"
+	Min Aggregate = "min"
+	Max Aggregate = "max"
+	P95 Aggregate = "p95"
+)
+
+const (
+	// MinRetention is the shortest raw datapoints retention, leaving them
+	// the time to be downsampled.
+	MinRetention = 15 * time.Minute
+
+	// rollupsDir is the session subdirectory of the downsampled
+	// datapoints.
+	rollupsDir = "rollups"
+	// downsampleEvery is how often recorded sessions get downsampled.
+	downsampleEvery = time.Minute
+	// downsampleDelay leaves the late datapoints the time to be persisted
+	// before their interval gets rolled up.
+	downsampleDelay = time.Minute
+	// maxListPoints is the most datapoints per series the auto resolution
+	// lists.
+	maxListPoints = 2000
+)
+
+var (
+	ErrUnknownResolution = errors.New("unknown resolution")
+	ErrUnknownAggregate  = errors.New("unknown aggregate")
+)
+
+// rollupResolutions are the downsampled resolutions, finest first.
+var rollupResolutions = []struct {
+	resolution Resolution
+	width      time.Duration
+}{
+	{Minute, time.Minute},
+	{FiveMinutes, 5 * time.Minute},
+}
+
+var aggregates = []Aggregate{Avg, Min, Max, P95}
+
+// ParseResolution parses the resolution name (empty means auto).
+func ParseResolution(name string) (Resolution, error) {
+	switch r := Resolution(name); r {
+	case "":
+		return Auto, nil
+	case Auto, Raw, Minute, FiveMinutes:
+		return r, nil
+	}
+	return "", fmt.Errorf("%w: '%s'", ErrUnknownResolution, name)
+}
+
+// ParseAggregate parses the aggregate name (empty means avg).
+func ParseAggregate(name string) (Aggregate, error) {
+	switch a := Aggregate(name); a {
+	case "":
+		return Avg, nil
+	case Avg, Min, Max, P95:
+		return a, nil
+	}
+	return "", fmt.Errorf("%w: '%s'", ErrUnknownAggregate, name)
+}
+
+// rollupMetric is the name of the downsampled series of the metric.
+func rollupMetric(metric string, res Resolution, agg Aggregate) string {
+	return metric + "_" + string(res) + "_" + string(agg)
+}
+
+// source is the store and series the datapoints get listed from.
+type source struct {
+	db         Storage
+	resolution Resolution
+	aggregate  Aggregate
+}
+
+// metric is the name of the metric series in the source.
+func (s source) metric(name string) string {
+	if s.resolution == Raw {
+		return name
+	}
+	return rollupMetric(name, s.resolution, s.aggregate)
+}
+
+// label is the resolution of the listed series, empty for raw ones.
+func (s source) label() string {
+	if s.resolution == Raw {
+		return ""
+	}
+	return string(s.resolution)
+}
+
+// aggregateLabel is the aggregate of the listed series, empty for raw
+// ones.
+func (s source) aggregateLabel() string {
+	if s.resolution == Raw {
+		return ""
+	}
+	return string(s.aggregate)
+}
+
+// source picks the datapoints source of the container. The auto
+// resolution is the finest one covering the span with at most
+// maxListPoints memory usage datapoints, or the coarsest one with
+// datapoints. The raw datapoints pruned out of the retention don't cover
+// the span anymore.
+func (r *Repository) source(c model.Container, sp span, opts ListOptions) (source, error) {
+	agg := opts.Aggregate
+	if agg == "" {
+		agg = Avg
+	}
+	raw := source{db: r.db, resolution: Raw}
+	switch opts.Resolution {
+	case Raw:
+		return raw, nil
+	case Minute, FiveMinutes:
+		return source{db: r.rollups, resolution: opts.Resolution, aggregate: agg}, nil
+	}
+
+	candidates := []source{raw}
+	for _, rr := range rollupResolutions {
+		candidates = append(candidates, source{db: r.rollups, resolution: rr.resolution, aggregate: agg})
+	}
+	labels := containerLabels(c)
+	counts := make([]int, len(candidates))
+	firsts := make([]int64, len(candidates))
+	earliest := int64(selectEnd)
+	for i, src := range candidates {
+		points, err := src.db.Select(src.metric(memoryUsageMetricName), labels, sp.start, sp.end)
+		if err != nil {
+			return source{}, err
+		}
+		counts[i] = len(points)
+		if len(points) > 0 {
+			firsts[i] = points[0].Timestamp
+			earliest = min(earliest, firsts[i])
+		}
+	}
+	coarsest := r.units(rollupResolutions[len(rollupResolutions)-1].width)
+	picked := raw
+	for i, src := range candidates {
+		if counts[i] == 0 {
+			continue
+		}
+		if counts[i] <= maxListPoints && firsts[i]-earliest < coarsest {
+			return src, nil
+		}
+		picked = src
+	}
+	return picked, nil
+}
+
+// startDownsampling downsamples the session in the background while it's
+// being recorded, until Close.
+func (r *Repository) startDownsampling() {
+	r.stop = make(chan struct{})
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(downsampleEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				// the failed intervals are retried on the next run
+				_ = r.Downsample(false)
+			}
+		}
+	}()
+}
+
+// Downsample rolls the raw datapoints not downsampled yet up into 1m and
+// 5m min/avg/max/p95 datapoints, then prunes the raw datapoints out of
+// the session retention. The intervals still being recorded are left for
+// later, unless final is set.
+func (r *Repository) Downsample(final bool) error {
+	r.downsampling.Lock()
+	defer r.downsampling.Unlock()
+
+	session := r.Session()
+	r.mu.Lock()
+	latest := r.latest
+	r.mu.Unlock()
+	if latest == 0 {
+		latest = r.timestamp(time.Now())
+	}
+
+	coarsest := r.units(rollupResolutions[len(rollupResolutions)-1].width)
+	var from int64
+	if session.DownsampledUntil != nil {
+		from = r.timestamp(*session.DownsampledUntil)
+	}
+	until := alignDown(latest-r.units(downsampleDelay), coarsest)
+	if final {
+		until = selectEnd
+	}
+	if until <= from {
+		return nil
+	}
+
+	var (
+		rows []Row
+		last int64 = -1
+	)
+	for _, s := range sessionSeries(session) {
+		points, err := r.db.Select(s.metric, s.labels, from, until)
+		if err != nil {
+			return fmt.Errorf("selecting %s datapoints: %w", s.metric, err)
+		}
+		if len(points) == 0 {
+			continue
+		}
+		last = max(last, points[len(points)-1].Timestamp)
+		for _, rr := range rollupResolutions {
+			rows = append(rows, rollup(s.metric, s.labels, rr.resolution, r.units(rr.width), points)...)
+		}
+	}
+	if len(rows) > 0 {
+		if err := r.rollups.Write(rows); err != nil {
+			return fmt.Errorf("writing downsampled datapoints: %w", err)
+		}
+	}
+
+	if final {
+		if last < 0 {
+			return nil
+		}
+		until = alignDown(last, coarsest) + coarsest
+	}
+	downsampledUntil := r.time(until)
+	r.mu.Lock()
+	r.session.DownsampledUntil = &downsampledUntil
+	err := writeSession(r.dataPath, r.session)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// the session latest datapoint is unknown when reopened, the ones
+	// just downsampled are the latest then
+	r.mu.Lock()
+	newest := max(r.latest, last)
+	r.mu.Unlock()
+	return r.prune(session.Retention, newest, until)
+}
+
+// prune drops the raw datapoints older than the retention, back from the
+// latest datapoint rather than from now, so replayed and imported
+// sessions keep them as much as recorded ones. The datapoints not
+// downsampled yet are kept.
+func (r *Repository) prune(retention time.Duration, latest, downsampledUntil int64) error {
+	p, ok := r.db.(pruner)
+	if !ok || retention <= 0 || latest <= 0 {
+		return nil
+	}
+	before := min(latest-r.units(retention), downsampledUntil)
+	r.mu.Lock()
+	pruned := r.session.PrunedUntil != nil && before <= r.timestamp(*r.session.PrunedUntil)
+	r.mu.Unlock()
+	if pruned {
+		return nil
+	}
+	if err := p.Prune(before); err != nil {
+		return fmt.Errorf("pruning raw datapoints: %w", err)
+	}
+
+	prunedUntil := r.time(before)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.session.PrunedUntil = &prunedUntil
+	return writeSession(r.dataPath, r.session)
+}
+
+// units is the duration in storage timestamp units.
+func (r *Repository) units(d time.Duration) int64 {
+	return r.timestamp(time.Unix(0, 0).Add(d))
+}
+
+// series is a raw metric series of the session.
+type series struct {
+	metric string
+	labels []Label
+}
+
+// sessionSeries are the raw series of the session containers.
+func sessionSeries(session model.Session) []series {
+	var resp []series
+	for _, sc := range session.Containers {
+		labels := containerLabels(sc.Container)
+		for _, m := range containerMetrics {
+			resp = append(resp, series{metric: m.name, labels: labels})
+		}
+		for _, name := range sc.Interfaces {
+			l := append(containerLabels(sc.Container), Label{Name: interfaceLabelName, Value: name})
+			for _, m := range networkMetrics {
+				resp = append(resp, series{metric: m, labels: l})
+			}
+		}
+		for _, device := range sc.Devices {
+			l := append(containerLabels(sc.Container), Label{Name: deviceLabelName, Value: device})
+			for _, m := range blkioMetrics {
+				resp = append(resp, series{metric: m, labels: l})
+			}
+		}
+		for core := 0; core < sc.Cores; core++ {
+			l := append(containerLabels(sc.Container), Label{Name: cpuLabelName, Value: strconv.Itoa(core)})
+			resp = append(resp, series{metric: cpuCorePercentageMetricName, labels: l})
+		}
+	}
+	return resp
+}
+
+// rollup aggregates the datapoints, oldest first, by interval of width
+// timestamp units. The downsampled datapoints are at their interval
+// start.
+func rollup(metric string, labels []Label, res Resolution, width int64, points []DataPoint) []Row {
+	var rows []Row
+	for i := 0; i < len(points); {
+		bucket := alignDown(points[i].Timestamp, width)
+		j := i
+		for j < len(points) && alignDown(points[j].Timestamp, width) == bucket {
+			j++
+		}
+		values := make([]float64, 0, j-i)
+		for _, dp := range points[i:j] {
+			values = append(values, dp.Value)
+		}
+		for _, agg := range aggregates {
+			rows = append(rows, Row{
+				Metric:    rollupMetric(metric, res, agg),
+				Labels:    labels,
+				DataPoint: DataPoint{Timestamp: bucket, Value: aggregate(values, agg)},
+			})
+		}
+		i = j
+	}
+	return rows
+}
+
+// aggregate computes the aggregate of the values, the p95 being the
+// nearest rank one.
+func aggregate(values []float64, agg Aggregate) float64 {
+	switch agg {
+	case Min:
+		return slices.Min(values)
+	case Max:
+		return slices.Max(values)
+	case P95:
+		sorted := slices.Clone(values)
+		slices.Sort(sorted)
+		rank := int(math.Ceil(0.95 * float64(len(sorted))))
+		return sorted[max(rank-1, 0)]
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// alignDown rounds the timestamp down to a multiple of width.
+func alignDown(ts, width int64) int64 {
+	return ts - ((ts%width)+width)%width
+}
@@ -0,0 +1,117 @@
+package persistence
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// recordOld persists an hour of web samples, 10s apart, recorded long
+// before now as imported and replayed captures are, then downsamples them.
+func recordOld(t *testing.T, kind StorageKind) *Repository {
+	t.Helper()
+	SetDataDir(t.TempDir())
+	t.Cleanup(func() {
+		SetDataDir("")
+	})
+	r, err := NewSession(SessionOptions{Storage: kind, Retention: MinRetention})
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+	for i := 0; i < 360; i++ {
+		s := statsSample("aaa111", "web", i)
+		s.Read = start.Add(time.Duration(i) * 10 * time.Second)
+		s.PreRead = s.Read.Add(-10 * time.Second)
+		if err := r.Persist(s); err != nil {
+			t.Fatalf("persisting sample %d: %v", i, err)
+		}
+	}
+	if err := r.Downsample(true); err != nil {
+		t.Fatalf("downsampling: %v", err)
+	}
+	return r
+}
+
+func TestPruneFromLatestDatapoint(t *testing.T) {
+	latest := start.Add(359 * 10 * time.Second)
+	for _, kind := range []StorageKind{Memory, SQLite} {
+		t.Run(string(kind), func(t *testing.T) {
+			r := reopen(t, recordOld(t, kind))
+
+			s := r.Session()
+			if want := latest.Add(-MinRetention); s.PrunedUntil == nil || !s.PrunedUntil.Equal(want) {
+				t.Fatalf("pruned until %v, want %s", s.PrunedUntil, want)
+			}
+			list, err := r.List(ListOptions{Resolution: Raw})
+			if err != nil {
+				t.Fatalf("listing raw datapoints: %v", err)
+			}
+			// the retention and the latest datapoint are both kept
+			if len(list) != 1 || len(list[0].Datapoints) != 91 {
+				t.Fatalf("listed %d raw datapoints, want the 91 of the retention", len(list[0].Datapoints))
+			}
+			if first := list[0].Datapoints[0].Timestamp; !first.Equal(latest.Add(-MinRetention)) {
+				t.Errorf("first raw datapoint at %s, want %s", first, latest.Add(-MinRetention))
+			}
+
+			list, err = r.List(ListOptions{Resolution: Minute, Aggregate: Max})
+			if err != nil {
+				t.Fatalf("listing rollups: %v", err)
+			}
+			if len(list[0].Datapoints) != 60 || list[0].Resolution != "1m" || list[0].Aggregate != "max" {
+				t.Errorf("listed %d '%s' '%s' datapoints, want 60 1m max ones", len(list[0].Datapoints), list[0].Resolution, list[0].Aggregate)
+			}
+			if got := list[0].Datapoints[0].MemoryUsage; got != 10*mib*6 {
+				t.Errorf("first minute max memory usage = %v, want %v", got, 10*mib*6)
+			}
+		})
+	}
+}
+
+func TestAutoResolutionAfterPrune(t *testing.T) {
+	r := reopen(t, recordOld(t, Memory))
+	list, err := r.List(ListOptions{})
+	if err != nil {
+		t.Fatalf("listing datapoints: %v", err)
+	}
+	// the raw datapoints left don't cover the session anymore
+	if len(list) != 1 || list[0].Resolution != "1m" || len(list[0].Datapoints) != 60 {
+		t.Errorf("listed %d '%s' datapoints, want the 60 1m ones", len(list[0].Datapoints), list[0].Resolution)
+	}
+}
+
+func TestNoRetentionKeepsRawDatapoints(t *testing.T) {
+	r := newMemorySession(t)
+	for i := 0; i < 120; i++ {
+		if err := r.Persist(statsSample("aaa111", "web", i)); err != nil {
+			t.Fatalf("persisting sample %d: %v", i, err)
+		}
+	}
+	if err := r.Downsample(true); err != nil {
+		t.Fatalf("downsampling: %v", err)
+	}
+	r = reopen(t, r)
+	if r.Session().PrunedUntil != nil {
+		t.Errorf("pruned until %s without retention", r.Session().PrunedUntil)
+	}
+	list, err := r.List(ListOptions{Resolution: Raw})
+	if err != nil {
+		t.Fatalf("listing raw datapoints: %v", err)
+	}
+	if len(list[0].Datapoints) != 120 {
+		t.Errorf("listed %d raw datapoints, want 120", len(list[0].Datapoints))
+	}
+}
+
+func TestRetentionUnsupportedOnTStorage(t *testing.T) {
+	SetDataDir(t.TempDir())
+	t.Cleanup(func() {
+		SetDataDir("")
+	})
+	for _, kind := range []StorageKind{"", TStorage} {
+		_, err := NewSession(SessionOptions{Storage: kind, Retention: MinRetention})
+		if !errors.Is(err, ErrRetentionUnsupported) {
+			t.Errorf("'%s' session error = %v, want %v", kind, err, ErrRetentionUnsupported)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"github.com/eldius/docker-profiler/internal/model"
+	"io"
+)
+
+// Import persists newline-delimited stats documents, as streamed by the
+// daemon stats endpoint, stamped with their own read time. Documents
+// missing the container ID, name or start time get the ones of c. It
+// returns the number of samples persisted.
+func (r *Repository) Import(in io.Reader, c model.Container) (int, error) {
+	dec := model.NewStatsDecoder(in)
+
+	count := 0
+	for {
+		var stats model.ContainerStats
+		err := dec.Decode(&stats)
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		line := dec.Line()
+		if stats.ID == "" {
+			stats.ID = c.ID
+		}
+		if stats.Name == "" {
+			stats.Name = c.Name
+		}
+		if stats.ID == "" {
+			return count, fmt.Errorf("stats at line %d: missing container id", line)
+		}
+		if stats.StartedAt.IsZero() {
+			stats.StartedAt = c.StartedAt
+		}
+		if err := r.Persist(stats); err != nil {
+			return count, fmt.Errorf("persisting stats at line %d: %w", line, err)
+		}
+		count++
+	}
+}
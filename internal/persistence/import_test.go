@@ -0,0 +1,151 @@
+package persistence
+
+import (
+	"github.com/eldius/docker-profiler/internal/model"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const mib = 1024 * 1024
+
+// newMemorySession records a session in memory, under a temporary data
+// directory.
+func newMemorySession(t *testing.T) *Repository {
+	t.Helper()
+	SetDataDir(t.TempDir())
+	t.Cleanup(func() {
+		SetDataDir("")
+	})
+	r, err := NewSession(SessionOptions{Storage: Memory})
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+	return r
+}
+
+// reopen closes the recorded session and opens it again.
+func reopen(t *testing.T, r *Repository) *Repository {
+	t.Helper()
+	id := r.Session().ID
+	if err := r.Close(); err != nil {
+		t.Fatalf("closing session: %v", err)
+	}
+	r, err := NewRepository(id)
+	if err != nil {
+		t.Fatalf("reopening session: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = r.Close()
+	})
+	return r
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestImportFixture(t *testing.T) {
+	f, err := os.Open("../model/testdata/stats.ndjson")
+	if err != nil {
+		t.Fatalf("opening fixture: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	r := newMemorySession(t)
+	count, err := r.Import(f, model.Container{})
+	if err != nil {
+		t.Fatalf("importing fixture: %v", err)
+	}
+	if count != 10 {
+		t.Errorf("imported %d samples, want 10", count)
+	}
+
+	list, err := reopen(t, r).List(ListOptions{})
+	if err != nil {
+		t.Fatalf("listing datapoints: %v", err)
+	}
+	if len(list) != 2 || list[0].Name != "db" || list[1].Name != "web" {
+		t.Fatalf("listed %d series, want db and web", len(list))
+	}
+	web := list[1]
+	if len(web.Datapoints) != 5 || web.Resolution != "" {
+		t.Fatalf("web has %d datapoints in '%s' resolution, want 5 raw", len(web.Datapoints), web.Resolution)
+	}
+
+	last := web.Datapoints[4]
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"memory usage", last.MemoryUsage, 100 * mib},
+		{"working set", last.MemoryWorkingSet, 80 * mib},
+		{"cpu", last.CPUPercentage, 50},
+		{"cpu user", last.CPUUserPercentage, 30},
+		{"throttled", last.ThrottledPercentage, 10},
+		{"pids", last.PidsCurrent, 7},
+		{"rx bytes", last.Networks["eth0"].RxBytes, 5000},
+		{"rx rate", last.Networks["eth0"].RxBytesRate, 1000},
+		{"read bytes", last.BlockIO["8:0"].ReadBytes, 5 * 4096},
+		{"write iops", last.BlockIO["8:0"].WriteIOPS, 2},
+	}
+	for _, tt := range tests {
+		if !approxEqual(tt.got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+	if len(last.CPUPerCore) != 2 || !approxEqual(last.CPUPerCore[0], 30) {
+		t.Errorf("per core cpu = %v, want [30 20]", last.CPUPerCore)
+	}
+}
+
+func TestImportMissingContainerID(t *testing.T) {
+	r := newMemorySession(t)
+	defer func() {
+		_ = r.Close()
+	}()
+
+	in := strings.NewReader(`{"read":"2024-03-01T10:00:01Z","memory_stats":{"usage":1}}` + "\n")
+	if _, err := r.Import(in, model.Container{}); err == nil || !strings.Contains(err.Error(), "missing container id") {
+		t.Errorf("import error = %v, want missing container id", err)
+	}
+	in = strings.NewReader(`{"read":"2024-03-01T10:00:01Z","memory_stats":{"usage":1}}` + "\n")
+	if count, err := r.Import(in, model.Container{ID: "web", Name: "web"}); err != nil || count != 1 {
+		t.Errorf("import = %d, %v, want 1 sample", count, err)
+	}
+}
+
+func TestImportStartedAt(t *testing.T) {
+	r := newMemorySession(t)
+	restarted := start.Add(time.Hour)
+	in := strings.NewReader(strings.Join([]string{
+		`{"id":"aaa111","name":"/web","read":"2024-03-01T10:00:01Z","memory_stats":{"usage":1}}`,
+		`{"id":"aaa111","name":"/web","read":"2024-03-01T10:00:02Z","memory_stats":{"usage":2}}`,
+		// the recorded start time wins over the given one
+		`{"started_at":"` + restarted.Format(time.RFC3339) + `","id":"aaa111","name":"/web","read":"2024-03-01T11:00:01Z","memory_stats":{"usage":3}}`,
+	}, "\n"))
+	if count, err := r.Import(in, model.Container{StartedAt: start}); err != nil || count != 3 {
+		t.Fatalf("import = %d, %v, want 3 samples", count, err)
+	}
+
+	list, err := reopen(t, r).List(ListOptions{Resolution: Raw})
+	if err != nil {
+		t.Fatalf("listing datapoints: %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("listed %d series, want one per lifecycle", len(list))
+	}
+	for i, want := range []struct {
+		startedAt  time.Time
+		datapoints int
+	}{{start, 2}, {restarted, 1}} {
+		if !list[i].StartedAt.Equal(want.startedAt) || len(list[i].Datapoints) != want.datapoints {
+			t.Errorf("lifecycle %d started at %s with %d datapoints, want %s with %d", i, list[i].StartedAt, len(list[i].Datapoints), want.startedAt, want.datapoints)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package persistence
+
+import (
+	"slices"
+	"sync"
+)
+
+var (
+	// memoryStores keeps the in-memory stores by session directory, so a
+	// session can be reopened for the life of the process.
+	memoryStores   = make(map[string]*memoryStorage)
+	memoryStoresMu sync.Mutex
+)
+
+// memoryStorage keeps the datapoints in memory, by series.
+type memoryStorage struct {
+	mu     sync.RWMutex
+	series map[string][]DataPoint
+}
+
+func openMemory(dataPath string) *memoryStorage {
+	memoryStoresMu.Lock()
+	defer memoryStoresMu.Unlock()
+
+	s, ok := memoryStores[dataPath]
+	if !ok {
+		s = &memoryStorage{series: make(map[string][]DataPoint)}
+		memoryStores[dataPath] = s
+	}
+	return s
+}
+
+func (s *memoryStorage) Write(rows []Row) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, row := range rows {
+		key := seriesKey(row.Metric, row.Labels)
+		s.series[key] = append(s.series[key], row.DataPoint)
+	}
+	return nil
+}
+
+func (s *memoryStorage) Select(metric string, labels []Label, start, end int64) ([]DataPoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var dps []DataPoint
+	for _, dp := range s.series[seriesKey(metric, labels)] {
+		if dp.Timestamp >= start && dp.Timestamp < end {
+			dps = append(dps, dp)
+		}
+	}
+	slices.SortStableFunc(dps, func(a, b DataPoint) int {
+		switch {
+		case a.Timestamp < b.Timestamp:
+			return -1
+		case a.Timestamp > b.Timestamp:
+			return 1
+		}
+		return 0
+	})
+	return dps, nil
+}
+
+func (s *memoryStorage) Prune(before int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, dps := range s.series {
+		dps = slices.DeleteFunc(dps, func(dp DataPoint) bool {
+			return dp.Timestamp < before
+		})
+		if len(dps) == 0 {
+			delete(s.series, key)
+			continue
+		}
+		s.series[key] = dps
+	}
+	return nil
+}
+
+// Close keeps the datapoints, for the session to be reopened.
+func (s *memoryStorage) Close() error {
+	return nil
+}
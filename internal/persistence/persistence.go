@@ -1,109 +1,863 @@
 package persistence
 
 import (
+	"errors"
 	"fmt"
+	"github.com/eldius/docker-profiler/internal/helper"
 	"github.com/eldius/docker-profiler/internal/model"
-	"github.com/nakabonne/tstorage"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	memoryUsageMetricName   = "memory_usage"
-	memoryLimitMetricName   = "memory_limit"
-	cpuOnlineMetricName     = "cpu_online"
-	cpuUsageMetricName      = "cpu_usage"
-	cpuPercentageMetricName = "cpu_percentage"
+	memoryUsageMetricName         = "memory_usage"
+	memoryLimitMetricName         = "memory_limit"
+	memoryWorkingSetMetricName    = "memory_working_set"
+	memoryAnonMetricName          = "memory_anon"
+	memoryFileMetricName          = "memory_file"
+	memoryShmemMetricName         = "memory_shmem"
+	memoryKernelStackMetricName   = "memory_kernel_stack"
+	memorySlabMetricName          = "memory_slab"
+	cpuOnlineMetricName           = "cpu_online"
+	cpuUsageMetricName            = "cpu_usage"
+	cpuPercentageMetricName       = "cpu_percentage"
+	cpuUserPercentageMetricName   = "cpu_user_percentage"
+	cpuKernelPercentageMetricName = "cpu_kernel_percentage"
+	cpuCorePercentageMetricName   = "cpu_core_percentage"
+	pidsCurrentMetricName         = "pids_current"
+	pidsLimitMetricName           = "pids_limit"
+	throttlingPeriodsMetricName   = "cpu_throttling_periods"
+	throttledPeriodsMetricName    = "cpu_throttled_periods"
+	throttledTimeMetricName       = "cpu_throttled_time"
+	throttledPercentageMetricName = "cpu_throttled_percentage"
+
+	exitCodeMetricName  = "exit_code"
+	oomKilledMetricName = "oom_killed"
+
+	networkRxBytesMetricName       = "network_rx_bytes"
+	networkRxPacketsMetricName     = "network_rx_packets"
+	networkRxErrorsMetricName      = "network_rx_errors"
+	networkRxDroppedMetricName     = "network_rx_dropped"
+	networkTxBytesMetricName       = "network_tx_bytes"
+	networkTxPacketsMetricName     = "network_tx_packets"
+	networkTxErrorsMetricName      = "network_tx_errors"
+	networkTxDroppedMetricName     = "network_tx_dropped"
+	networkRxBytesRateMetricName   = "network_rx_bytes_rate"
+	networkRxPacketsRateMetricName = "network_rx_packets_rate"
+	networkTxBytesRateMetricName   = "network_tx_bytes_rate"
+	networkTxPacketsRateMetricName = "network_tx_packets_rate"
+
+	blkioReadBytesMetricName      = "blkio_read_bytes"
+	blkioWriteBytesMetricName     = "blkio_write_bytes"
+	blkioReadOpsMetricName        = "blkio_read_ops"
+	blkioWriteOpsMetricName       = "blkio_write_ops"
+	blkioReadBytesRateMetricName  = "blkio_read_bytes_rate"
+	blkioWriteBytesRateMetricName = "blkio_write_bytes_rate"
+	blkioReadIOPSMetricName       = "blkio_read_iops"
+	blkioWriteIOPSMetricName      = "blkio_write_iops"
+
+	containerIDLabelName      = "container_id"
+	containerNameLabelName    = "container_name"
+	containerStartedLabelName = "container_started_at"
+	interfaceLabelName        = "interface"
+	deviceLabelName           = "device"
+	cpuLabelName              = "cpu"
+
+	// selectEnd is the (exclusive) end of unbounded ranges. Samples are
+	// stamped by the daemon, whose clock can be ahead of ours.
+	selectEnd = math.MaxInt64
 )
 
-func NewRepository(name string) *Repository {
-	dir, err := os.Getwd()
+// NewRepository opens the storage of an existing profiling session, in
+// the backend it was recorded with.
+func NewRepository(sessionID string) (*Repository, error) {
+	dataPath, err := sessionPath(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	session, err := readSession(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	return openRepository(dataPath, session)
+}
+
+// openRepository opens the raw and the downsampled datapoints stores of
+// the session.
+func openRepository(dataPath string, session model.Session) (*Repository, error) {
+	kind := StorageKind(session.Storage)
+	precision := sessionPrecision(session)
+	db, err := openStorage(kind, dataPath, precision)
+	if err != nil {
+		return nil, fmt.Errorf("opening session storage: %w", err)
+	}
+	rollupsPath := filepath.Join(dataPath, rollupsDir)
+	if err := os.MkdirAll(rollupsPath, 0o755); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("creating session rollups directory: %w", err)
+	}
+	rollups, err := openStorage(kind, rollupsPath, precision)
 	if err != nil {
-		err = fmt.Errorf("getting working directory: %w", err)
-		panic(err)
+		_ = db.Close()
+		return nil, fmt.Errorf("opening session rollups storage: %w", err)
 	}
-	storage, _ := tstorage.NewStorage(
-		tstorage.WithTimestampPrecision(tstorage.Seconds),
-		tstorage.WithDataPath(filepath.Join(dir, ".data", name)),
-	)
-	return &Repository{db: storage}
+	return &Repository{
+		db:        db,
+		rollups:   rollups,
+		dataPath:  dataPath,
+		session:   session,
+		precision: precision,
+	}, nil
 }
 
 type Repository struct {
-	db tstorage.Storage
+	db Storage
+	// rollups holds the downsampled datapoints, out of the raw datapoints
+	// retention.
+	rollups   Storage
+	dataPath  string
+	precision timestampPrecision
+	// downsampling serializes the downsampling runs.
+	downsampling sync.Mutex
+	// stop ends the background downsampling, when running.
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex
+	session model.Session
+	// recording is set for repositories of sessions being profiled, so
+	// the session end gets recorded on Close.
+	recording bool
+	// last keeps the previous sample of each container lifecycle, to
+	// derive rates from cumulative counters.
+	last map[string]sample
+	// latest is the timestamp of the most recent sample persisted.
+	latest int64
+}
+
+// sample is a persisted container stats sample.
+type sample struct {
+	stats model.ContainerStats
+	at    time.Time
 }
 
 func (r *Repository) Persist(s model.ContainerStats) error {
-	unixTimestamp := time.Now().Unix()
-	return r.db.InsertRows([]tstorage.Row{
+	c := s.Container()
+	if err := r.registerContainer(s); err != nil {
+		return err
+	}
+	labels := containerLabels(c)
+	at := s.ReadAt()
+	unixTimestamp := r.timestamp(at)
+	prev, hasPrev := r.swapLast(c, sample{stats: s, at: at})
+	elapsed := at.Sub(prev.at)
+	if !s.Read.IsZero() && !s.PreRead.IsZero() {
+		elapsed = s.Read.Sub(s.PreRead)
+	}
+	mem := s.MemoryBreakdown()
+
+	rows := []Row{
 		{
 			Metric:    memoryUsageMetricName,
-			DataPoint: tstorage.DataPoint{Timestamp: unixTimestamp, Value: float64(s.MemoryStats.Usage)},
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(s.MemoryStats.Usage)},
 		},
 		{
 			Metric:    memoryLimitMetricName,
-			DataPoint: tstorage.DataPoint{Timestamp: unixTimestamp, Value: float64(s.MemoryStats.Limit)},
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(s.MemoryStats.Limit)},
+		},
+		{
+			Metric:    memoryWorkingSetMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(s.MemoryWorkingSet())},
+		},
+		{
+			Metric:    memoryAnonMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(mem.Anon)},
+		},
+		{
+			Metric:    memoryFileMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(mem.File)},
+		},
+		{
+			Metric:    memoryShmemMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(mem.Shmem)},
+		},
+		{
+			Metric:    memoryKernelStackMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(mem.KernelStack)},
+		},
+		{
+			Metric:    memorySlabMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(mem.Slab)},
 		},
 		{
 			Metric:    cpuOnlineMetricName,
-			DataPoint: tstorage.DataPoint{Timestamp: unixTimestamp, Value: float64(s.CPUStats.OnlineCPUs)},
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(s.CPUStats.OnlineCPUs)},
 		},
 		{
 			Metric:    cpuUsageMetricName,
-			DataPoint: tstorage.DataPoint{Timestamp: unixTimestamp, Value: float64(s.CPUStats.CPUUsage.TotalUsage)},
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(s.CPUStats.CPUUsage.TotalUsage)},
 		},
 		{
 			Metric:    cpuPercentageMetricName,
-			DataPoint: tstorage.DataPoint{Timestamp: unixTimestamp, Value: s.CPUUsagePercentage()},
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: s.CPUUsagePercentage()},
 		},
-	})
+		{
+			Metric:    cpuUserPercentageMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: s.CPUUserPercentage()},
+		},
+		{
+			Metric:    cpuKernelPercentageMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: s.CPUKernelPercentage()},
+		},
+		{
+			Metric:    pidsCurrentMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(s.PidsStats.Current)},
+		},
+		{
+			Metric:    pidsLimitMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(s.PidsStats.Limit)},
+		},
+		{
+			Metric:    throttlingPeriodsMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(s.CPUStats.ThrottlingData.Periods)},
+		},
+		{
+			Metric:    throttledPeriodsMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(s.CPUStats.ThrottlingData.ThrottledPeriods)},
+		},
+		{
+			Metric:    throttledTimeMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(s.CPUStats.ThrottlingData.ThrottledTime)},
+		},
+		{
+			Metric:    throttledPercentageMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: s.CPUThrottledPercentage()},
+		},
+	}
+
+	for i, v := range s.CPUPerCorePercentage() {
+		rows = append(rows, Row{
+			Metric:    cpuCorePercentageMetricName,
+			Labels:    append(containerLabels(c), Label{Name: cpuLabelName, Value: strconv.Itoa(i)}),
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: v},
+		})
+	}
+
+	for name, n := range s.Networks {
+		netLabels := append(containerLabels(c), Label{Name: interfaceLabelName, Value: name})
+		values := map[string]uint64{
+			networkRxBytesMetricName:   n.RxBytes,
+			networkRxPacketsMetricName: n.RxPackets,
+			networkRxErrorsMetricName:  n.RxErrors,
+			networkRxDroppedMetricName: n.RxDropped,
+			networkTxBytesMetricName:   n.TxBytes,
+			networkTxPacketsMetricName: n.TxPackets,
+			networkTxErrorsMetricName:  n.TxErrors,
+			networkTxDroppedMetricName: n.TxDropped,
+		}
+		for metric, v := range values {
+			rows = append(rows, Row{
+				Metric:    metric,
+				Labels:    netLabels,
+				DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(v)},
+			})
+		}
+
+		p, ok := prev.stats.Networks[name]
+		if !hasPrev || !ok {
+			continue
+		}
+		rates := map[string]float64{
+			networkRxBytesRateMetricName:   helper.Rate(n.RxBytes, p.RxBytes, elapsed),
+			networkRxPacketsRateMetricName: helper.Rate(n.RxPackets, p.RxPackets, elapsed),
+			networkTxBytesRateMetricName:   helper.Rate(n.TxBytes, p.TxBytes, elapsed),
+			networkTxPacketsRateMetricName: helper.Rate(n.TxPackets, p.TxPackets, elapsed),
+		}
+		for metric, v := range rates {
+			rows = append(rows, Row{
+				Metric:    metric,
+				Labels:    netLabels,
+				DataPoint: DataPoint{Timestamp: unixTimestamp, Value: v},
+			})
+		}
+	}
+
+	var prevBlockIO map[string]model.BlockIOCounters
+	if hasPrev {
+		prevBlockIO = prev.stats.BlockIO()
+	}
+	for device, b := range s.BlockIO() {
+		devLabels := append(containerLabels(c), Label{Name: deviceLabelName, Value: device})
+		values := map[string]uint64{
+			blkioReadBytesMetricName:  b.ReadBytes,
+			blkioWriteBytesMetricName: b.WriteBytes,
+			blkioReadOpsMetricName:    b.ReadOps,
+			blkioWriteOpsMetricName:   b.WriteOps,
+		}
+		for metric, v := range values {
+			rows = append(rows, Row{
+				Metric:    metric,
+				Labels:    devLabels,
+				DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(v)},
+			})
+		}
+
+		p, ok := prevBlockIO[device]
+		if !ok {
+			continue
+		}
+		rates := map[string]float64{
+			blkioReadBytesRateMetricName:  helper.Rate(b.ReadBytes, p.ReadBytes, elapsed),
+			blkioWriteBytesRateMetricName: helper.Rate(b.WriteBytes, p.WriteBytes, elapsed),
+			blkioReadIOPSMetricName:       helper.Rate(b.ReadOps, p.ReadOps, elapsed),
+			blkioWriteIOPSMetricName:      helper.Rate(b.WriteOps, p.WriteOps, elapsed),
+		}
+		for metric, v := range rates {
+			rows = append(rows, Row{
+				Metric:    metric,
+				Labels:    devLabels,
+				DataPoint: DataPoint{Timestamp: unixTimestamp, Value: v},
+			})
+		}
+	}
+
+	return r.db.Write(rows)
 }
 
-func (r *Repository) List() ([]model.MetricsDatapoint, error) {
-	mups, err := r.db.Select(memoryUsageMetricName, make([]tstorage.Label, 0), 0, time.Now().Unix())
-	if err != nil {
-		err = fmt.Errorf("listing memory usage datapoints: %w", err)
+// swapLast stores the sample as the latest one of the container lifecycle
+// and returns the previous one.
+func (r *Repository) swapLast(c model.Container, s sample) (sample, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.last == nil {
+		r.last = make(map[string]sample)
+	}
+	if ts := r.timestamp(s.at); ts > r.latest {
+		r.latest = ts
 	}
-	mlps, err := r.db.Select(memoryLimitMetricName, make([]tstorage.Label, 0), 0, time.Now().Unix())
+	prev, ok := r.last[c.Segment()]
+	r.last[c.Segment()] = s
+	return prev, ok
+}
+
+// PersistExit records the exit code and OOM killed flag of the container
+// next to its metrics.
+func (r *Repository) PersistExit(c model.Container, exit model.ContainerExit) error {
+	err := r.updateContainer(c, func(sc *model.SessionContainer) {
+		sc.Exit = &exit
+	})
 	if err != nil {
-		err = fmt.Errorf("listing memory limit datapoints: %w", err)
+		return err
+	}
+
+	oomKilled := 0.0
+	if exit.OOMKilled {
+		oomKilled = 1
+	}
+	labels := containerLabels(c)
+	unixTimestamp := r.timestamp(exit.At)
+	return r.db.Write([]Row{
+		{
+			Metric:    exitCodeMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: float64(exit.Code)},
+		},
+		{
+			Metric:    oomKilledMetricName,
+			Labels:    labels,
+			DataPoint: DataPoint{Timestamp: unixTimestamp, Value: oomKilled},
+		},
+	})
+}
+
+// ListOptions narrows the datapoints listed.
+type ListOptions struct {
+	// From and To bound the datapoints timestamps, both inclusive (zero
+	// means unbounded).
+	From time.Time
+	To   time.Time
+	// Containers keeps only the containers with one of the names or ID
+	// prefixes, when set.
+	Containers []string
+	// Resolution is the interval of the datapoints listed. Auto (or not
+	// set) picks the finest one keeping each series under a few thousand
+	// datapoints.
+	Resolution Resolution
+	// Aggregate is the value downsampled datapoints get (avg when not
+	// set).
+	Aggregate Aggregate
+}
+
+// Matches tells whether the container passes the container filter.
+func (o ListOptions) Matches(c model.Container) bool {
+	if len(o.Containers) == 0 {
+		return true
+	}
+	for _, f := range o.Containers {
+		if c.Name == f || strings.HasPrefix(c.ID, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the stored datapoints grouped by container lifecycle, in
+// the resolution asked for or the one fitting the range.
+func (r *Repository) List(opts ListOptions) ([]model.ContainerSeries, error) {
+	session := r.Session()
+	span := r.span(opts)
+	var resp []model.ContainerSeries
+	for _, sc := range session.Containers {
+		if !opts.Matches(sc.Container) {
+			continue
+		}
+		src, err := r.source(sc.Container, span, opts)
+		if err != nil {
+			return nil, fmt.Errorf("resolving datapoints of '%s': %w", sc.Name, err)
+		}
+		dps, err := r.listContainer(sc, src, span)
+		if err != nil {
+			return nil, fmt.Errorf("listing datapoints of '%s': %w", sc.Name, err)
+		}
+		resp = append(resp, model.ContainerSeries{
+			SessionID:        session.ID,
+			SessionContainer: sc,
+			Resolution:       src.label(),
+			Aggregate:        src.aggregateLabel(),
+			Datapoints:       dps,
+		})
+	}
+	return resp, nil
+}
+
+// Session returns the session metadata, with containers sorted by name
+// and start time.
+func (r *Repository) Session() model.Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session := r.session
+	session.Containers = make([]model.SessionContainer, len(r.session.Containers))
+	copy(session.Containers, r.session.Containers)
+	sort.Slice(session.Containers, func(i, j int) bool {
+		ci, cj := session.Containers[i], session.Containers[j]
+		if ci.Name == cj.Name {
+			if ci.StartedAt.Equal(cj.StartedAt) {
+				return ci.ID < cj.ID
+			}
+			return ci.StartedAt.Before(cj.StartedAt)
+		}
+		return ci.Name < cj.Name
+	})
+	return session
+}
+
+// RegisterContainer records the container metadata (image, limits) in
+// the session.
+func (r *Repository) RegisterContainer(info model.SessionContainer) error {
+	return r.updateContainer(info.Container, func(sc *model.SessionContainer) {
+		exit := sc.Exit
+		*sc = info
+		if sc.Exit == nil {
+			sc.Exit = exit
+		}
+	})
+}
+
+var (
+	// networkMetrics are the per network interface metrics.
+	networkMetrics = []string{
+		networkRxBytesMetricName,
+		networkRxPacketsMetricName,
+		networkRxErrorsMetricName,
+		networkRxDroppedMetricName,
+		networkTxBytesMetricName,
+		networkTxPacketsMetricName,
+		networkTxErrorsMetricName,
+		networkTxDroppedMetricName,
+		networkRxBytesRateMetricName,
+		networkRxPacketsRateMetricName,
+		networkTxBytesRateMetricName,
+		networkTxPacketsRateMetricName,
+	}
+	// blkioMetrics are the per block device metrics.
+	blkioMetrics = []string{
+		blkioReadBytesMetricName,
+		blkioWriteBytesMetricName,
+		blkioReadOpsMetricName,
+		blkioWriteOpsMetricName,
+		blkioReadBytesRateMetricName,
+		blkioWriteBytesRateMetricName,
+		blkioReadIOPSMetricName,
+		blkioWriteIOPSMetricName,
+	}
+)
+
+// containerMetrics are the per container metrics joined into datapoints,
+// with the field each one fills.
+var containerMetrics = []struct {
+	name string
+	set  func(dp *model.MetricsDatapoint, v float64)
+}{
+	{memoryUsageMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.MemoryUsage = v }},
+	{memoryLimitMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.MemoryLimit = v }},
+	{memoryWorkingSetMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.MemoryWorkingSet = v }},
+	{memoryAnonMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.MemoryAnon = v }},
+	{memoryFileMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.MemoryFile = v }},
+	{memoryShmemMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.MemoryShmem = v }},
+	{memoryKernelStackMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.MemoryKernelStack = v }},
+	{memorySlabMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.MemorySlab = v }},
+	{cpuOnlineMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.CPUOnlineCount = v }},
+	{cpuUsageMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.CPUUsage = v }},
+	{cpuPercentageMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.CPUPercentage = v }},
+	{cpuUserPercentageMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.CPUUserPercentage = v }},
+	{cpuKernelPercentageMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.CPUKernelPercentage = v }},
+	{pidsCurrentMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.PidsCurrent = v }},
+	{pidsLimitMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.PidsLimit = v }},
+	{throttlingPeriodsMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.ThrottlingPeriods = v }},
+	{throttledPeriodsMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.ThrottledPeriods = v }},
+	{throttledTimeMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.ThrottledTime = v }},
+	{throttledPercentageMetricName, func(dp *model.MetricsDatapoint, v float64) { dp.ThrottledPercentage = v }},
+}
+
+func containerMetricNames() []string {
+	names := make([]string, len(containerMetrics))
+	for i, m := range containerMetrics {
+		names[i] = m.name
 	}
-	cops, err := r.db.Select(cpuOnlineMetricName, make([]tstorage.Label, 0), 0, time.Now().Unix())
+	return names
+}
+
+// listContainer joins the container metrics on timestamp. A metric missing
+// at a timestamp carries its previous value forward and gets reported in
+// the datapoint Missing list.
+func (r *Repository) listContainer(sc model.SessionContainer, src source, sp span) ([]model.MetricsDatapoint, error) {
+	labels := containerLabels(sc.Container)
+	values, err := r.selectValues(src, labels, sp, containerMetricNames()...)
 	if err != nil {
-		err = fmt.Errorf("listing online cpu count datapoints: %w", err)
+		return nil, err
 	}
-	cups, err := r.db.Select(cpuUsageMetricName, make([]tstorage.Label, 0), 0, time.Now().Unix())
+
+	var timestamps []int64
+	for _, points := range values {
+		for ts := range points {
+			timestamps = append(timestamps, ts)
+		}
+	}
+	slices.Sort(timestamps)
+	timestamps = slices.Compact(timestamps)
+
+	resp := make([]model.MetricsDatapoint, len(timestamps))
+	last := make(map[string]float64, len(containerMetrics))
+	for i, ts := range timestamps {
+		resp[i].Timestamp = r.time(ts)
+		for _, m := range containerMetrics {
+			v, ok := values[m.name][ts]
+			if ok {
+				last[m.name] = v
+			} else {
+				v = last[m.name]
+				resp[i].Missing = append(resp[i].Missing, m.name)
+			}
+			m.set(&resp[i], v)
+		}
+	}
+
+	var errs []error
+	for _, name := range sc.Interfaces {
+		errs = append(errs, r.listNetwork(sc.Container, name, resp, src, sp))
+	}
+	for _, device := range sc.Devices {
+		errs = append(errs, r.listBlockIO(sc.Container, device, resp, src, sp))
+	}
+	errs = append(errs, r.listCores(sc.Container, sc.Cores, resp, src, sp))
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// listNetwork fills the network datapoints of the interface, matching
+// them by timestamp.
+func (r *Repository) listNetwork(c model.Container, name string, dps []model.MetricsDatapoint, src source, sp span) error {
+	labels := append(containerLabels(c), Label{Name: interfaceLabelName, Value: name})
+	values, err := r.selectValues(src, labels, sp, networkMetrics...)
 	if err != nil {
-		err = fmt.Errorf("listing online cpu count datapoints: %w", err)
+		return fmt.Errorf("listing datapoints for interface '%s': %w", name, err)
+	}
+
+	for i := range dps {
+		ts := r.timestamp(dps[i].Timestamp)
+		if _, ok := values[networkRxBytesMetricName][ts]; !ok {
+			continue
+		}
+		if dps[i].Networks == nil {
+			dps[i].Networks = make(map[string]model.NetworkDatapoint)
+		}
+		dps[i].Networks[name] = model.NetworkDatapoint{
+			RxBytes:       values[networkRxBytesMetricName][ts],
+			RxPackets:     values[networkRxPacketsMetricName][ts],
+			RxErrors:      values[networkRxErrorsMetricName][ts],
+			RxDropped:     values[networkRxDroppedMetricName][ts],
+			TxBytes:       values[networkTxBytesMetricName][ts],
+			TxPackets:     values[networkTxPacketsMetricName][ts],
+			TxErrors:      values[networkTxErrorsMetricName][ts],
+			TxDropped:     values[networkTxDroppedMetricName][ts],
+			RxBytesRate:   values[networkRxBytesRateMetricName][ts],
+			RxPacketsRate: values[networkRxPacketsRateMetricName][ts],
+			TxBytesRate:   values[networkTxBytesRateMetricName][ts],
+			TxPacketsRate: values[networkTxPacketsRateMetricName][ts],
+		}
 	}
-	cpps, err := r.db.Select(cpuPercentageMetricName, make([]tstorage.Label, 0), 0, time.Now().Unix())
+	return nil
+}
+
+// listBlockIO fills the block I/O datapoints of the device, matching
+// them by timestamp.
+func (r *Repository) listBlockIO(c model.Container, device string, dps []model.MetricsDatapoint, src source, sp span) error {
+	labels := append(containerLabels(c), Label{Name: deviceLabelName, Value: device})
+	values, err := r.selectValues(src, labels, sp, blkioMetrics...)
 	if err != nil {
-		err = fmt.Errorf("listing online cpu count datapoints: %w", err)
+		return fmt.Errorf("listing datapoints for device '%s': %w", device, err)
 	}
 
-	resp := make([]model.MetricsDatapoint, len(mups))
-	for i := range mups {
-		resp[i] = model.MetricsDatapoint{
-			Timestamp:      time.Unix(mups[i].Timestamp, 0),
-			MemoryUsage:    getValue(mups, i),
-			MemoryLimit:    getValue(mlps, i),
-			CPUOnlineCount: getValue(cops, i),
-			CPUUsage:       getValue(cups, i),
-			CPUPercentage:  getValue(cpps, i),
+	for i := range dps {
+		ts := r.timestamp(dps[i].Timestamp)
+		if _, ok := values[blkioReadBytesMetricName][ts]; !ok {
+			continue
+		}
+		if dps[i].BlockIO == nil {
+			dps[i].BlockIO = make(map[string]model.BlockIODatapoint)
+		}
+		dps[i].BlockIO[device] = model.BlockIODatapoint{
+			ReadBytes:      values[blkioReadBytesMetricName][ts],
+			WriteBytes:     values[blkioWriteBytesMetricName][ts],
+			ReadOps:        values[blkioReadOpsMetricName][ts],
+			WriteOps:       values[blkioWriteOpsMetricName][ts],
+			ReadBytesRate:  values[blkioReadBytesRateMetricName][ts],
+			WriteBytesRate: values[blkioWriteBytesRateMetricName][ts],
+			ReadIOPS:       values[blkioReadIOPSMetricName][ts],
+			WriteIOPS:      values[blkioWriteIOPSMetricName][ts],
 		}
 	}
-	return resp, nil
+	return nil
 }
 
+// listCores fills the per core usage datapoints, matching them by
+// timestamp.
+func (r *Repository) listCores(c model.Container, cores int, dps []model.MetricsDatapoint, src source, sp span) error {
+	for core := 0; core < cores; core++ {
+		labels := append(containerLabels(c), Label{Name: cpuLabelName, Value: strconv.Itoa(core)})
+		values, err := r.selectValues(src, labels, sp, cpuCorePercentageMetricName)
+		if err != nil {
+			return fmt.Errorf("listing datapoints for cpu %d: %w", core, err)
+		}
+		for i := range dps {
+			v, ok := values[cpuCorePercentageMetricName][r.timestamp(dps[i].Timestamp)]
+			if !ok {
+				continue
+			}
+			if dps[i].CPUPerCore == nil {
+				dps[i].CPUPerCore = make([]float64, cores)
+			}
+			dps[i].CPUPerCore[core] = v
+		}
+	}
+	return nil
+}
+
+// selectValues selects the metrics series with the labels from the
+// source, indexed by metric name and timestamp. Metrics without
+// datapoints are empty, and the failures are all reported.
+func (r *Repository) selectValues(src source, labels []Label, sp span, metrics ...string) (map[string]map[int64]float64, error) {
+	values := make(map[string]map[int64]float64, len(metrics))
+	var errs []error
+	for _, metric := range metrics {
+		points, err := src.db.Select(src.metric(metric), labels, sp.start, sp.end)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listing %s datapoints: %w", metric, err))
+		}
+		values[metric] = byTimestamp(points)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Close flushes the session. Recorded sessions get their remaining
+// datapoints downsampled, and their end saved.
 func (r *Repository) Close() error {
-	return r.db.Close()
+	var errs []error
+	if r.recording {
+		if r.stop != nil {
+			close(r.stop)
+			r.wg.Wait()
+		}
+		errs = append(errs, r.Downsample(true))
+
+		r.mu.Lock()
+		endedAt := time.Now()
+		r.session.EndedAt = &endedAt
+		errs = append(errs, writeSession(r.dataPath, r.session))
+		r.mu.Unlock()
+	}
+	errs = append(errs, r.db.Close(), r.rollups.Close())
+	return errors.Join(errs...)
+}
+
+// registerContainer adds the container, its network interfaces, block
+// devices and cores to the session so their series can be found again
+// by List.
+func (r *Repository) registerContainer(s model.ContainerStats) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := s.Container()
+	changed := false
+	i := r.findContainer(c)
+	if i < 0 {
+		r.session.Containers = append(r.session.Containers, model.SessionContainer{Container: c})
+		i = len(r.session.Containers) - 1
+		changed = true
+	}
+	sc := &r.session.Containers[i]
+	for name := range s.Networks {
+		if !slices.Contains(sc.Interfaces, name) {
+			sc.Interfaces = append(sc.Interfaces, name)
+			changed = true
+		}
+	}
+	for device := range s.BlockIO() {
+		if !slices.Contains(sc.Devices, device) {
+			sc.Devices = append(sc.Devices, device)
+			changed = true
+		}
+	}
+	if cores := len(s.CPUStats.CPUUsage.PercpuUsage); cores > sc.Cores {
+		sc.Cores = cores
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return writeSession(r.dataPath, r.session)
 }
 
-func getValue(dps []*tstorage.DataPoint, index int) float64 {
-	if len(dps) < index {
-		return 0
+// updateContainer applies fn to the session container entry, adding it
+// when missing, and saves the session.
+func (r *Repository) updateContainer(c model.Container, fn func(sc *model.SessionContainer)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.findContainer(c)
+	if i < 0 {
+		r.session.Containers = append(r.session.Containers, model.SessionContainer{Container: c})
+		i = len(r.session.Containers) - 1
+	}
+	fn(&r.session.Containers[i])
+	return writeSession(r.dataPath, r.session)
+}
+
+func (r *Repository) findContainer(c model.Container) int {
+	for i, sc := range r.session.Containers {
+		if sc.Segment() == c.Segment() {
+			return i
+		}
+	}
+	return -1
+}
+
+func containerLabels(c model.Container) []Label {
+	labels := []Label{
+		{Name: containerIDLabelName, Value: c.ID},
+		{Name: containerNameLabelName, Value: c.Name},
+	}
+	if !c.StartedAt.IsZero() {
+		labels = append(labels, Label{
+			Name:  containerStartedLabelName,
+			Value: c.StartedAt.UTC().Format(time.RFC3339Nano),
+		})
 	}
+	return labels
+}
+
+// span is a storage timestamp range, with an exclusive end.
+type span struct {
+	start int64
+	end   int64
+}
 
-	return dps[index].Value
+// span converts the list time bounds to a storage timestamp range.
+func (r *Repository) span(opts ListOptions) span {
+	sp := span{start: 0, end: selectEnd}
+	if !opts.From.IsZero() {
+		sp.start = r.timestamp(opts.From)
+	}
+	if !opts.To.IsZero() {
+		sp.end = r.timestamp(opts.To) + 1
+	}
+	return sp
+}
+
+// timestamp converts the time to a storage timestamp, in the session
+// precision.
+func (r *Repository) timestamp(t time.Time) int64 {
+	switch r.precision {
+	case milliseconds:
+		return t.UnixMilli()
+	case microseconds:
+		return t.UnixMicro()
+	case nanoseconds:
+		return t.UnixNano()
+	}
+	return t.Unix()
+}
+
+// time converts the storage timestamp back to time.
+func (r *Repository) time(ts int64) time.Time {
+	switch r.precision {
+	case milliseconds:
+		return time.UnixMilli(ts)
+	case microseconds:
+		return time.UnixMicro(ts)
+	case nanoseconds:
+		return time.Unix(0, ts)
+	}
+	return time.Unix(ts, 0)
+}
+
+func byTimestamp(dps []DataPoint) map[int64]float64 {
+	values := make(map[int64]float64, len(dps))
+	for _, dp := range dps {
+		values[dp.Timestamp] = dp.Value
+	}
+	return values
 }
@@ -0,0 +1,412 @@
+package persistence
+
+import (
+	"github.com/docker/docker/api/types"
+	"github.com/eldius/docker-profiler/internal/model"
+	"slices"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+// statsSample returns the i-th stats sample of the container, read a second
+// apart, receiving 1000 bytes/s on eth0.
+func statsSample(id, name string, i int) model.ContainerStats {
+	var s model.ContainerStats
+	s.ID = id
+	s.Name = "/" + name
+	s.Read = start.Add(time.Duration(i) * time.Second)
+	s.PreRead = s.Read.Add(-time.Second)
+	s.MemoryStats.Usage = uint64(10 * mib * (i + 1))
+	s.MemoryStats.Limit = 512 * mib
+	s.CPUStats.OnlineCPUs = 2
+	s.CPUStats.SystemUsage = uint64(4000 * (i + 1))
+	s.CPUStats.CPUUsage.TotalUsage = uint64(1000 * (i + 1))
+	s.PreCPUStats.SystemUsage = uint64(4000 * i)
+	s.PreCPUStats.CPUUsage.TotalUsage = uint64(1000 * i)
+	s.PidsStats.Current = uint64(i + 1)
+	s.Networks = map[string]types.NetworkStats{
+		"eth0": {RxBytes: uint64(1000 * (i + 1))},
+	}
+	return s
+}
+
+func TestPersistListRoundTrip(t *testing.T) {
+	r := newMemorySession(t)
+	for i := 0; i < 3; i++ {
+		if err := r.Persist(statsSample("aaa111", "web", i)); err != nil {
+			t.Fatalf("persisting web: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := r.Persist(statsSample("bbb222", "db", i)); err != nil {
+			t.Fatalf("persisting db: %v", err)
+		}
+	}
+	exit := model.ContainerExit{Code: 137, OOMKilled: true, At: start.Add(3 * time.Second)}
+	if err := r.PersistExit(model.Container{ID: "aaa111", Name: "web"}, exit); err != nil {
+		t.Fatalf("persisting exit: %v", err)
+	}
+
+	r = reopen(t, r)
+	list, err := r.List(ListOptions{Resolution: Raw})
+	if err != nil {
+		t.Fatalf("listing datapoints: %v", err)
+	}
+	if len(list) != 2 || list[0].Name != "db" || list[1].Name != "web" {
+		t.Fatalf("listed %d series, want db and web", len(list))
+	}
+
+	web := list[1]
+	if len(web.Datapoints) != 3 {
+		t.Fatalf("web has %d datapoints, want 3", len(web.Datapoints))
+	}
+	if web.Exit == nil || web.Exit.Code != 137 || !web.Exit.OOMKilled {
+		t.Errorf("web exit = %+v, want OOM killed 137", web.Exit)
+	}
+	if !slices.Equal(web.Interfaces, []string{"eth0"}) {
+		t.Errorf("web interfaces = %v, want [eth0]", web.Interfaces)
+	}
+	for i, dp := range web.Datapoints {
+		if !dp.Timestamp.Equal(start.Add(time.Duration(i) * time.Second)) {
+			t.Errorf("datapoint %d at %s, want %s", i, dp.Timestamp, start.Add(time.Duration(i)*time.Second))
+		}
+		if want := float64(10 * mib * (i + 1)); dp.MemoryUsage != want {
+			t.Errorf("datapoint %d memory usage = %v, want %v", i, dp.MemoryUsage, want)
+		}
+		if dp.CPUPercentage != 50 {
+			t.Errorf("datapoint %d cpu = %v, want 50", i, dp.CPUPercentage)
+		}
+		if dp.PidsCurrent != float64(i+1) {
+			t.Errorf("datapoint %d pids = %v, want %d", i, dp.PidsCurrent, i+1)
+		}
+		if got := dp.Networks["eth0"].RxBytes; got != float64(1000*(i+1)) {
+			t.Errorf("datapoint %d rx bytes = %v, want %d", i, got, 1000*(i+1))
+		}
+	}
+	if got := web.Datapoints[2].Networks["eth0"].RxBytesRate; got != 1000 {
+		t.Errorf("rx rate = %v, want 1000", got)
+	}
+}
+
+func TestListFilters(t *testing.T) {
+	r := newMemorySession(t)
+	for i := 0; i < 5; i++ {
+		for _, c := range []struct{ id, name string }{{"aaa111", "web"}, {"bbb222", "db"}} {
+			if err := r.Persist(statsSample(c.id, c.name, i)); err != nil {
+				t.Fatalf("persisting %s: %v", c.name, err)
+			}
+		}
+	}
+	r = reopen(t, r)
+
+	tests := []struct {
+		name       string
+		opts       ListOptions
+		containers []string
+		datapoints int
+	}{
+		{"all", ListOptions{}, []string{"db", "web"}, 5},
+		{"by name", ListOptions{Containers: []string{"web"}}, []string{"web"}, 5},
+		{"by id prefix", ListOptions{Containers: []string{"bbb"}}, []string{"db"}, 5},
+		{"from", ListOptions{From: start.Add(3 * time.Second)}, []string{"db", "web"}, 2},
+		{"to", ListOptions{To: start.Add(time.Second)}, []string{"db", "web"}, 2},
+		{"range", ListOptions{From: start.Add(time.Second), To: start.Add(3 * time.Second)}, []string{"db", "web"}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := r.List(tt.opts)
+			if err != nil {
+				t.Fatalf("listing datapoints: %v", err)
+			}
+			var names []string
+			for _, cs := range list {
+				names = append(names, cs.Name)
+				if len(cs.Datapoints) != tt.datapoints {
+					t.Errorf("'%s' has %d datapoints, want %d", cs.Name, len(cs.Datapoints), tt.datapoints)
+				}
+			}
+			if !slices.Equal(names, tt.containers) {
+				t.Errorf("listed %v, want %v", names, tt.containers)
+			}
+		})
+	}
+}
+
+func TestListOptionsMatches(t *testing.T) {
+	c := model.Container{ID: "aaa111bbb222", Name: "web"}
+	tests := []struct {
+		containers []string
+		want       bool
+	}{
+		{nil, true},
+		{[]string{"web"}, true},
+		{[]string{"db", "aaa1"}, true},
+		{[]string{"aaa111bbb222"}, true},
+		{[]string{"we"}, false},
+		{[]string{"bbb222"}, false},
+		{[]string{"db"}, false},
+	}
+	for _, tt := range tests {
+		if got := (ListOptions{Containers: tt.containers}).Matches(c); got != tt.want {
+			t.Errorf("containers %v match = %v, want %v", tt.containers, got, tt.want)
+		}
+	}
+}
+
+func TestParseStorage(t *testing.T) {
+	tests := []struct {
+		name string
+		want StorageKind
+		err  bool
+	}{
+		{"tstorage", TStorage, false},
+		{"sqlite", SQLite, false},
+		// tests only, its datapoints don't outlive the process
+		{"memory", "", true},
+		{"bolt", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseStorage(tt.name)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("ParseStorage(%q) = %q, %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestListLifecycleSegments(t *testing.T) {
+	r := newMemorySession(t)
+	// the container gets recreated with the same ID after its third sample
+	restarted := start.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		s := statsSample("aaa111", "web", i)
+		s.StartedAt = start
+		if i >= 3 {
+			s.StartedAt = restarted
+			s.Read = restarted.Add(time.Duration(i) * time.Second)
+		}
+		if err := r.Persist(s); err != nil {
+			t.Fatalf("persisting sample %d: %v", i, err)
+		}
+	}
+
+	list, err := reopen(t, r).List(ListOptions{Resolution: Raw})
+	if err != nil {
+		t.Fatalf("listing datapoints: %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("listed %d series, want one per lifecycle", len(list))
+	}
+	for i, want := range []struct {
+		startedAt  time.Time
+		datapoints int
+	}{{start, 3}, {restarted, 2}} {
+		if !list[i].StartedAt.Equal(want.startedAt) || len(list[i].Datapoints) != want.datapoints {
+			t.Errorf("segment %d started at %s with %d datapoints, want %s with %d", i, list[i].StartedAt, len(list[i].Datapoints), want.startedAt, want.datapoints)
+		}
+	}
+	if list[0].Segment() == list[1].Segment() {
+		t.Errorf("both segments are %s", list[0].Segment())
+	}
+}
+
+func TestNetworkRates(t *testing.T) {
+	r := newMemorySession(t)
+	counters := []map[string]types.NetworkStats{
+		{"eth0": {RxBytes: 1000, RxPackets: 10, TxBytes: 500, TxPackets: 5}, "eth1": {RxBytes: 10}},
+		{"eth0": {RxBytes: 5000, RxPackets: 30, TxBytes: 1500, TxPackets: 9}, "eth1": {RxBytes: 30}},
+		// eth0 counters reset, as when the interface gets recreated
+		{"eth0": {RxBytes: 100, RxPackets: 1, TxBytes: 50, TxPackets: 1}, "eth1": {RxBytes: 50}},
+	}
+	for i, networks := range counters {
+		s := statsSample("aaa111", "web", 2*i)
+		s.PreRead = time.Time{}
+		s.Networks = networks
+		if err := r.Persist(s); err != nil {
+			t.Fatalf("persisting sample %d: %v", i, err)
+		}
+	}
+
+	list, err := reopen(t, r).List(ListOptions{Resolution: Raw})
+	if err != nil {
+		t.Fatalf("listing datapoints: %v", err)
+	}
+	web := list[0]
+	if !slices.Equal(web.Interfaces, []string{"eth0", "eth1"}) {
+		t.Fatalf("interfaces = %v, want [eth0 eth1]", web.Interfaces)
+	}
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"eth0 rx bytes", web.Datapoints[1].Networks["eth0"].RxBytes, 5000},
+		{"eth0 tx packets", web.Datapoints[1].Networks["eth0"].TxPackets, 9},
+		// 2s between the samples
+		{"eth0 rx rate", web.Datapoints[1].Networks["eth0"].RxBytesRate, 2000},
+		{"eth0 rx packets rate", web.Datapoints[1].Networks["eth0"].RxPacketsRate, 10},
+		{"eth0 tx rate", web.Datapoints[1].Networks["eth0"].TxBytesRate, 500},
+		{"eth0 tx packets rate", web.Datapoints[1].Networks["eth0"].TxPacketsRate, 2},
+		{"eth1 rx rate", web.Datapoints[1].Networks["eth1"].RxBytesRate, 10},
+		{"eth0 rx rate after reset", web.Datapoints[2].Networks["eth0"].RxBytesRate, 0},
+		{"eth1 rx rate after eth0 reset", web.Datapoints[2].Networks["eth1"].RxBytesRate, 10},
+		{"first rx rate", web.Datapoints[0].Networks["eth0"].RxBytesRate, 0},
+	}
+	for _, tt := range tests {
+		if !approxEqual(tt.got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestBlockIORates(t *testing.T) {
+	r := newMemorySession(t)
+	for i := 0; i < 2; i++ {
+		s := statsSample("aaa111", "web", 2*i)
+		s.PreRead = s.Read.Add(-2 * time.Second)
+		s.BlkioStats.IoServiceBytesRecursive = []types.BlkioStatEntry{
+			{Major: 8, Minor: 0, Op: "read", Value: uint64(4096 * (i + 1))},
+			{Major: 8, Minor: 0, Op: "write", Value: uint64(8192 * (i + 1))},
+		}
+		s.BlkioStats.IoServicedRecursive = []types.BlkioStatEntry{
+			{Major: 8, Minor: 0, Op: "read", Value: uint64(2 * (i + 1))},
+			{Major: 8, Minor: 0, Op: "write", Value: uint64(6 * (i + 1))},
+		}
+		if err := r.Persist(s); err != nil {
+			t.Fatalf("persisting sample %d: %v", i, err)
+		}
+	}
+
+	list, err := reopen(t, r).List(ListOptions{Resolution: Raw})
+	if err != nil {
+		t.Fatalf("listing datapoints: %v", err)
+	}
+	web := list[0]
+	if !slices.Equal(web.Devices, []string{"8:0"}) {
+		t.Fatalf("devices = %v, want [8:0]", web.Devices)
+	}
+	// 2s between the samples
+	got := web.Datapoints[1].BlockIO["8:0"]
+	want := model.BlockIODatapoint{
+		ReadBytes: 8192, WriteBytes: 16384, ReadOps: 4, WriteOps: 12,
+		ReadBytesRate: 2048, WriteBytesRate: 4096, ReadIOPS: 1, WriteIOPS: 3,
+	}
+	if got != want {
+		t.Errorf("block io = %+v, want %+v", got, want)
+	}
+}
+
+func TestPids(t *testing.T) {
+	r := newMemorySession(t)
+	for i, limit := range []uint64{100, 0} {
+		s := statsSample("aaa111", "web", i)
+		s.PidsStats.Current = uint64(40 + i)
+		s.PidsStats.Limit = limit
+		if err := r.Persist(s); err != nil {
+			t.Fatalf("persisting sample %d: %v", i, err)
+		}
+	}
+
+	list, err := reopen(t, r).List(ListOptions{Resolution: Raw})
+	if err != nil {
+		t.Fatalf("listing datapoints: %v", err)
+	}
+	dps := list[0].Datapoints
+	// no limit is listed as 0
+	for i, want := range []struct{ current, limit float64 }{{40, 100}, {41, 0}} {
+		if dps[i].PidsCurrent != want.current || dps[i].PidsLimit != want.limit {
+			t.Errorf("datapoint %d pids = %v/%v, want %v/%v", i, dps[i].PidsCurrent, dps[i].PidsLimit, want.current, want.limit)
+		}
+	}
+}
+
+func TestCPUModesAndCores(t *testing.T) {
+	r := newMemorySession(t)
+	for i := 0; i < 2; i++ {
+		s := statsSample("aaa111", "web", i)
+		s.CPUStats.CPUUsage.UsageInUsermode = uint64(600 * (i + 1))
+		s.CPUStats.CPUUsage.UsageInKernelmode = uint64(400 * (i + 1))
+		s.PreCPUStats.CPUUsage.UsageInUsermode = uint64(600 * i)
+		s.PreCPUStats.CPUUsage.UsageInKernelmode = uint64(400 * i)
+		s.CPUStats.CPUUsage.PercpuUsage = []uint64{uint64(800 * (i + 1)), uint64(200 * (i + 1))}
+		s.PreCPUStats.CPUUsage.PercpuUsage = []uint64{uint64(800 * i), uint64(200 * i)}
+		if err := r.Persist(s); err != nil {
+			t.Fatalf("persisting sample %d: %v", i, err)
+		}
+	}
+	// a container without per core usage (cgroup v2)
+	if err := r.Persist(statsSample("bbb222", "db", 0)); err != nil {
+		t.Fatalf("persisting db: %v", err)
+	}
+
+	list, err := reopen(t, r).List(ListOptions{Resolution: Raw})
+	if err != nil {
+		t.Fatalf("listing datapoints: %v", err)
+	}
+	var web, db model.ContainerSeries
+	for _, cs := range list {
+		switch cs.Name {
+		case "web":
+			web = cs
+		case "db":
+			db = cs
+		}
+	}
+	if web.Cores != 2 {
+		t.Fatalf("web cores = %d, want 2", web.Cores)
+	}
+	for i, dp := range web.Datapoints {
+		if !approxEqual(dp.CPUUserPercentage, 30) || !approxEqual(dp.CPUKernelPercentage, 20) {
+			t.Errorf("datapoint %d user/kernel cpu = %v/%v, want 30/20", i, dp.CPUUserPercentage, dp.CPUKernelPercentage)
+		}
+		if len(dp.CPUPerCore) != 2 || !approxEqual(dp.CPUPerCore[0], 40) || !approxEqual(dp.CPUPerCore[1], 10) {
+			t.Errorf("datapoint %d per core cpu = %v, want [40 10]", i, dp.CPUPerCore)
+		}
+	}
+	if db.Cores != 0 || db.Datapoints[0].CPUPerCore != nil {
+		t.Errorf("db per core cpu = %d cores %v, want none", db.Cores, db.Datapoints[0].CPUPerCore)
+	}
+}
+
+func TestListCarriesMissingMetricsForward(t *testing.T) {
+	r := newMemorySession(t)
+	for i := 0; i < 2; i++ {
+		if err := r.Persist(statsSample("aaa111", "web", i)); err != nil {
+			t.Fatalf("persisting sample %d: %v", i, err)
+		}
+	}
+	// a later timestamp storing the memory usage only
+	c := statsSample("aaa111", "web", 0).Container()
+	at := start.Add(2 * time.Second)
+	row := Row{
+		Metric:    memoryUsageMetricName,
+		Labels:    containerLabels(c),
+		DataPoint: DataPoint{Timestamp: r.timestamp(at), Value: 30 * mib},
+	}
+	if err := r.db.Write([]Row{row}); err != nil {
+		t.Fatalf("writing memory usage: %v", err)
+	}
+
+	list, err := r.List(ListOptions{Resolution: Raw})
+	if err != nil {
+		t.Fatalf("listing datapoints: %v", err)
+	}
+	dps := list[0].Datapoints
+	if len(dps) != 3 {
+		t.Fatalf("listed %d datapoints, want 3", len(dps))
+	}
+	if len(dps[1].Missing) != 0 {
+		t.Errorf("complete datapoint misses %v", dps[1].Missing)
+	}
+	last := dps[2]
+	if !last.Timestamp.Equal(at) || last.MemoryUsage != 30*mib {
+		t.Errorf("last datapoint at %s uses %v bytes, want %s and %d", last.Timestamp, last.MemoryUsage, at, 30*mib)
+	}
+	if last.MemoryLimit != dps[1].MemoryLimit || last.CPUPercentage != dps[1].CPUPercentage {
+		t.Errorf("last datapoint limit/cpu = %v/%v, want the previous %v/%v", last.MemoryLimit, last.CPUPercentage, dps[1].MemoryLimit, dps[1].CPUPercentage)
+	}
+	if slices.Contains(last.Missing, memoryUsageMetricName) || !slices.Contains(last.Missing, cpuPercentageMetricName) {
+		t.Errorf("last datapoint misses %v, want every metric but the memory usage", last.Missing)
+	}
+}
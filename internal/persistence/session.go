@@ -0,0 +1,240 @@
+package persistence
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eldius/docker-profiler/internal/model"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	sessionsDir = "sessions"
+	sessionFile = "session.json"
+
+	// DataDirEnv names the environment variable setting the data
+	// directory.
+	DataDirEnv = "DOCKER_PROFILER_DATA_DIR"
+	appDir     = "docker-profiler"
+)
+
+var (
+	// dataDirOverride is the data directory set with SetDataDir.
+	dataDirOverride string
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+// SessionOptions describes a new profiling session.
+type SessionOptions struct {
+	// Args are the command line arguments of the session.
+	Args []string
+	// Note is a free-form note about the session.
+	Note string
+	// Interval is the sampling interval (0 means the daemon stats stream
+	// rate, ~1s). Sub-second intervals store millisecond timestamps, so
+	// fast samples don't collide on the same second.
+	Interval time.Duration
+	// Storage is the storage backend of the datapoints (tstorage when
+	// not set).
+	Storage StorageKind
+	// Retention is how long the raw datapoints are kept once downsampled,
+	// back from the latest one (0 keeps them). It can't be under
+	// MinRetention, nor be set on tstorage.
+	Retention time.Duration
+}
+
+// NewSession creates a new profiling session and opens its repository.
+func NewSession(opts SessionOptions) (*Repository, error) {
+	if opts.Retention > 0 && opts.Retention < MinRetention {
+		return nil, fmt.Errorf("retention must be at least %s, so the datapoints get downsampled first", MinRetention)
+	}
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	precision := seconds
+	if opts.Interval > 0 && opts.Interval < time.Second {
+		precision = milliseconds
+	}
+	storageKind := opts.Storage
+	if storageKind == "" {
+		storageKind = TStorage
+	}
+	if opts.Retention > 0 && !storageKind.prunes() {
+		return nil, fmt.Errorf("%w: %s keeps every datapoint, use sqlite for a retention", ErrRetentionUnsupported, storageKind)
+	}
+	session := model.Session{
+		ID:        id,
+		StartedAt: time.Now(),
+		Args:      opts.Args,
+		Note:      opts.Note,
+		Interval:  opts.Interval,
+		Precision: string(precision),
+		Storage:   string(storageKind),
+		Retention: opts.Retention,
+	}
+	dataPath, err := sessionPath(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dataPath, 0o755); err != nil {
+		return nil, fmt.Errorf("creating session directory: %w", err)
+	}
+	r, err := openRepository(dataPath, session)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeSession(dataPath, session); err != nil {
+		_ = r.db.Close()
+		_ = r.rollups.Close()
+		return nil, err
+	}
+	r.recording = true
+	r.startDownsampling()
+	return r, nil
+}
+
+// ListSessions returns the recorded sessions, oldest first.
+func ListSessions() ([]model.Session, error) {
+	dir, err := DataDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, sessionsDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing sessions: %w", err)
+	}
+
+	var sessions []model.Session
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		s, err := readSession(filepath.Join(dir, sessionsDir, e.Name()))
+		if errors.Is(err, ErrSessionNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.Before(sessions[j].StartedAt)
+	})
+	return sessions, nil
+}
+
+// LoadSession returns the metadata of the session.
+func LoadSession(id string) (model.Session, error) {
+	dataPath, err := sessionPath(id)
+	if err != nil {
+		return model.Session{}, err
+	}
+	return readSession(dataPath)
+}
+
+// DeleteSession removes the session metadata and its datapoints.
+func DeleteSession(id string) error {
+	if _, err := LoadSession(id); err != nil {
+		return err
+	}
+	dataPath, err := sessionPath(id)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dataPath); err != nil {
+		return fmt.Errorf("deleting session '%s': %w", id, err)
+	}
+	return nil
+}
+
+// sessionPrecision returns the timestamp precision of the session, the
+// sessions recorded before it was configurable use seconds.
+func sessionPrecision(s model.Session) timestampPrecision {
+	switch p := timestampPrecision(s.Precision); p {
+	case nanoseconds, microseconds, milliseconds, seconds:
+		return p
+	}
+	return seconds
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating session id: %w", err)
+	}
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b), nil
+}
+
+// SetDataDir sets the directory holding the sessions, taking precedence
+// over the environment and the default one.
+func SetDataDir(dir string) {
+	dataDirOverride = dir
+}
+
+// DataDir returns the directory holding the sessions: the one set with
+// SetDataDir, else $DOCKER_PROFILER_DATA_DIR, else docker-profiler under
+// the XDG data home (~/.local/share by default).
+func DataDir() (string, error) {
+	if dataDirOverride != "" {
+		return filepath.Abs(dataDirOverride)
+	}
+	if dir := os.Getenv(DataDirEnv); dir != "" {
+		return filepath.Abs(dir)
+	}
+	// relative XDG paths are invalid and must be ignored
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, appDir), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("locating data directory: %w", err)
+	}
+	return filepath.Join(home, ".local", "share", appDir), nil
+}
+
+func sessionPath(id string) (string, error) {
+	dir, err := DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, sessionsDir, filepath.Base(id)), nil
+}
+
+func readSession(dataPath string) (model.Session, error) {
+	var s model.Session
+	b, err := os.ReadFile(filepath.Join(dataPath, sessionFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, fmt.Errorf("%w: %s", ErrSessionNotFound, filepath.Base(dataPath))
+	}
+	if err != nil {
+		return s, fmt.Errorf("reading session: %w", err)
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("decoding session: %w", err)
+	}
+	return s, nil
+}
+
+func writeSession(dataPath string, s model.Session) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding session: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dataPath, sessionFile), b, 0o644); err != nil {
+		return fmt.Errorf("writing session: %w", err)
+	}
+	return nil
+}
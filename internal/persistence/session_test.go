@@ -0,0 +1,188 @@
+package persistence
+
+import (
+	"errors"
+	"github.com/eldius/docker-profiler/internal/model"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSessionMetadata(t *testing.T) {
+	SetDataDir(t.TempDir())
+	t.Cleanup(func() {
+		SetDataDir("")
+	})
+	r, err := NewSession(SessionOptions{Args: []string{"-profile", "-image", "alpine"}, Note: "soak test", Storage: Memory})
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+	id := r.Session().ID
+	info := model.SessionContainer{
+		Container:   model.Container{ID: "aaa111", Name: "web", StartedAt: start},
+		Image:       "alpine",
+		ImageDigest: "alpine@sha256:abc",
+		Limits:      model.Limits{Memory: 512 * mib, NanoCPUs: 2e9},
+	}
+	if err := r.RegisterContainer(info); err != nil {
+		t.Fatalf("registering container: %v", err)
+	}
+	s := statsSample("aaa111", "web", 0)
+	s.StartedAt = start
+	if err := r.Persist(s); err != nil {
+		t.Fatalf("persisting: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("closing session: %v", err)
+	}
+
+	got, err := LoadSession(id)
+	if err != nil {
+		t.Fatalf("loading session: %v", err)
+	}
+	if got.Note != "soak test" || !slices.Equal(got.Args, []string{"-profile", "-image", "alpine"}) {
+		t.Errorf("loaded note %q and args %v", got.Note, got.Args)
+	}
+	if got.EndedAt == nil || got.EndedAt.Before(got.StartedAt) {
+		t.Errorf("session ended at %v, want after its start %s", got.EndedAt, got.StartedAt)
+	}
+	if len(got.Containers) != 1 {
+		t.Fatalf("session has %d containers, want 1", len(got.Containers))
+	}
+	c := got.Containers[0]
+	if c.ImageDigest != info.ImageDigest || c.Limits.CPUs() != 2 || c.Limits.Memory != 512*mib {
+		t.Errorf("recorded container %+v, want %+v", c, info)
+	}
+}
+
+func TestListAndDeleteSessions(t *testing.T) {
+	SetDataDir(t.TempDir())
+	t.Cleanup(func() {
+		SetDataDir("")
+	})
+	if sessions, err := ListSessions(); err != nil || len(sessions) != 0 {
+		t.Fatalf("listed %v, %v, want no sessions", sessions, err)
+	}
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		r, err := NewSession(SessionOptions{Storage: Memory})
+		if err != nil {
+			t.Fatalf("creating session: %v", err)
+		}
+		ids = append(ids, r.Session().ID)
+		if err := r.Close(); err != nil {
+			t.Fatalf("closing session: %v", err)
+		}
+	}
+
+	sessions, err := ListSessions()
+	if err != nil {
+		t.Fatalf("listing sessions: %v", err)
+	}
+	var listed []string
+	for _, s := range sessions {
+		listed = append(listed, s.ID)
+	}
+	if !slices.Equal(listed, ids) {
+		t.Errorf("listed %v, want the sessions oldest first %v", listed, ids)
+	}
+
+	if err := DeleteSession(ids[1]); err != nil {
+		t.Fatalf("deleting session: %v", err)
+	}
+	if _, err := LoadSession(ids[1]); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("loading deleted session error = %v, want %v", err, ErrSessionNotFound)
+	}
+	if err := DeleteSession(ids[1]); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("deleting it again error = %v, want %v", err, ErrSessionNotFound)
+	}
+	if sessions, _ := ListSessions(); len(sessions) != 2 {
+		t.Errorf("listed %d sessions after deleting one, want 2", len(sessions))
+	}
+}
+
+func TestSubSecondInterval(t *testing.T) {
+	SetDataDir(t.TempDir())
+	t.Cleanup(func() {
+		SetDataDir("")
+	})
+	tests := []struct {
+		interval  time.Duration
+		precision timestampPrecision
+	}{
+		{0, seconds},
+		{time.Second, seconds},
+		{100 * time.Millisecond, milliseconds},
+	}
+	for _, tt := range tests {
+		r, err := NewSession(SessionOptions{Interval: tt.interval, Storage: Memory})
+		if err != nil {
+			t.Fatalf("creating session: %v", err)
+		}
+		if p := sessionPrecision(r.Session()); p != tt.precision {
+			t.Errorf("interval %s precision = %s, want %s", tt.interval, p, tt.precision)
+		}
+		if tt.precision != milliseconds {
+			_ = r.Close()
+			continue
+		}
+		// samples within the same second are kept apart
+		for i := 0; i < 3; i++ {
+			s := statsSample("aaa111", "web", 0)
+			s.Read = start.Add(time.Duration(i) * tt.interval)
+			s.PreRead = s.Read.Add(-tt.interval)
+			if err := r.Persist(s); err != nil {
+				t.Fatalf("persisting sample %d: %v", i, err)
+			}
+		}
+		list, err := reopen(t, r).List(ListOptions{Resolution: Raw})
+		if err != nil {
+			t.Fatalf("listing datapoints: %v", err)
+		}
+		if len(list) != 1 || len(list[0].Datapoints) != 3 {
+			t.Fatalf("listed %v, want 3 datapoints", list)
+		}
+		for i, dp := range list[0].Datapoints {
+			if want := start.Add(time.Duration(i) * tt.interval); !dp.Timestamp.Equal(want) {
+				t.Errorf("datapoint %d at %s, want %s", i, dp.Timestamp, want)
+			}
+		}
+	}
+}
+
+func TestDataDir(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	tests := []struct {
+		name     string
+		override string
+		env      string
+		xdg      string
+		want     string
+	}{
+		{"default", "", "", "", filepath.Join(home, ".local", "share", "docker-profiler")},
+		{"xdg", "", "", "/xdg/data", "/xdg/data/docker-profiler"},
+		{"relative xdg", "", "", "xdg/data", filepath.Join(home, ".local", "share", "docker-profiler")},
+		{"env", "", "/env/data", "/xdg/data", "/env/data"},
+		{"override", "/override", "/env/data", "/xdg/data", "/override"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetDataDir(tt.override)
+			t.Cleanup(func() {
+				SetDataDir("")
+			})
+			t.Setenv(DataDirEnv, tt.env)
+			t.Setenv("XDG_DATA_HOME", tt.xdg)
+			got, err := DataDir()
+			if err != nil {
+				t.Fatalf("locating data directory: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("data directory = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package persistence
+
+import (
+	"database/sql"
+	"fmt"
+	_ "modernc.org/sqlite"
+	"net/url"
+	"path/filepath"
+)
+
+const sqliteFile = "datapoints.db"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS datapoints (
+	series    TEXT    NOT NULL,
+	timestamp INTEGER NOT NULL,
+	value     REAL    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS datapoints_series ON datapoints (series, timestamp);
+CREATE INDEX IF NOT EXISTS datapoints_timestamp ON datapoints (timestamp);
+`
+
+// sqliteStorage keeps the datapoints in a SQLite database under the
+// session directory, one row per datapoint.
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+func openSQLite(dataPath string) (*sqliteStorage, error) {
+	dsn := (&url.URL{
+		Scheme:   "file",
+		Path:     filepath.Join(dataPath, sqliteFile),
+		RawQuery: "_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)",
+	}).String()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening sqlite database: %w", err)
+	}
+	// a single connection serializes the writes, which SQLite does anyway
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("creating sqlite schema: %w", err)
+	}
+	return &sqliteStorage{db: db}, nil
+}
+
+func (s *sqliteStorage) Write(rows []Row) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	stmt, err := tx.Prepare("INSERT INTO datapoints (series, timestamp, value) VALUES (?, ?, ?)")
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("preparing insert: %w", err)
+	}
+	defer func() {
+		_ = stmt.Close()
+	}()
+	for _, row := range rows {
+		if _, err := stmt.Exec(seriesKey(row.Metric, row.Labels), row.Timestamp, row.Value); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("inserting %s datapoint: %w", row.Metric, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing datapoints: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStorage) Select(metric string, labels []Label, start, end int64) ([]DataPoint, error) {
+	rows, err := s.db.Query(
+		"SELECT timestamp, value FROM datapoints WHERE series = ? AND timestamp >= ? AND timestamp < ? ORDER BY timestamp, rowid",
+		seriesKey(metric, labels), start, end,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var dps []DataPoint
+	for rows.Next() {
+		var dp DataPoint
+		if err := rows.Scan(&dp.Timestamp, &dp.Value); err != nil {
+			return nil, err
+		}
+		dps = append(dps, dp)
+	}
+	return dps, rows.Err()
+}
+
+func (s *sqliteStorage) Prune(before int64) error {
+	if _, err := s.db.Exec("DELETE FROM datapoints WHERE timestamp < ?", before); err != nil {
+		return fmt.Errorf("pruning datapoints: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStorage) Close() error {
+	return s.db.Close()
+}
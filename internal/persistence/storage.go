@@ -0,0 +1,129 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Storage is the time-series store holding the datapoints of a session.
+type Storage interface {
+	// Write stores the rows.
+	Write(rows []Row) error
+	// Select returns the datapoints of the series with exactly the metric
+	// and labels, in the [start, end) timestamp range, oldest first. No
+	// datapoints isn't an error.
+	Select(metric string, labels []Label, start, end int64) ([]DataPoint, error)
+	// Close flushes the pending writes and releases the store.
+	Close() error
+}
+
+// pruner is implemented by the stores able to drop old datapoints. Only
+// their sessions take a retention.
+type pruner interface {
+	// Prune drops the datapoints older than the timestamp.
+	Prune(before int64) error
+}
+
+// Label is a name/value pair identifying a series, next to its metric.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// DataPoint is a series value at a timestamp, in the session precision.
+type DataPoint struct {
+	Timestamp int64
+	Value     float64
+}
+
+// Row is a datapoint of a series.
+type Row struct {
+	Metric string
+	Labels []Label
+	DataPoint
+}
+
+// StorageKind is a storage backend.
+type StorageKind string
+
+const (
+	// TStorage keeps the datapoints in tstorage partitions, the default.
+	TStorage StorageKind = "tstorage"
+	// SQLite keeps the datapoints in an embedded SQLite database.
+	SQLite StorageKind = "sqlite"
+	// Memory keeps the datapoints in memory, for the life of the process.
+	// It's meant for tests, the session metadata still lands on disk, so
+	// ParseStorage doesn't offer it.
+	Memory StorageKind = "memory"
+)
+
+var (
+	ErrUnknownStorage = errors.New("unknown storage backend")
+	// ErrRetentionUnsupported is returned for a retention on a backend
+	// unable to prune datapoints.
+	ErrRetentionUnsupported = errors.New("retention unsupported by the storage backend")
+)
+
+// prunes tells whether the backend stores implement pruner. tstorage only
+// expires whole partitions by their creation time, not the datapoints one.
+func (k StorageKind) prunes() bool {
+	return k == SQLite || k == Memory
+}
+
+// ParseStorage parses the name of a storage backend outliving the process.
+func ParseStorage(name string) (StorageKind, error) {
+	switch k := StorageKind(name); k {
+	case TStorage, SQLite:
+		return k, nil
+	}
+	return "", fmt.Errorf("%w: '%s'", ErrUnknownStorage, name)
+}
+
+// openStorage opens the session store of the backend at dataPath. The
+// sessions recorded before the backend was configurable use tstorage.
+func openStorage(kind StorageKind, dataPath string, precision timestampPrecision) (Storage, error) {
+	switch kind {
+	case TStorage, "":
+		return openTStorage(dataPath, precision)
+	case SQLite:
+		return openSQLite(dataPath)
+	case Memory:
+		return openMemory(dataPath), nil
+	}
+	return nil, fmt.Errorf("%w: '%s'", ErrUnknownStorage, kind)
+}
+
+// timestampPrecision is the unit of the stored timestamps.
+type timestampPrecision string
+
+const (
+	nanoseconds  timestampPrecision = "ns"
+	microseconds timestampPrecision = "us"
+	milliseconds timestampPrecision = "ms"
+	seconds      timestampPrecision = "s"
+)
+
+// seriesKey identifies the series of the metric and labels, whatever the
+// order of the labels.
+func seriesKey(metric string, labels []Label) string {
+	sorted := slices.Clone(labels)
+	slices.SortFunc(sorted, func(a, b Label) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	var sb strings.Builder
+	sb.WriteString(metric)
+	sb.WriteByte('{')
+	for i, l := range sorted {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(l.Name)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(l.Value))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
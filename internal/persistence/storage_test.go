@@ -0,0 +1,81 @@
+package persistence
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestStorageBackends(t *testing.T) {
+	web := []Label{{Name: "container_id", Value: "aaa111"}, {Name: "container_name", Value: "web"}}
+	db := []Label{{Name: "container_id", Value: "bbb222"}, {Name: "container_name", Value: "db"}}
+	for _, kind := range []StorageKind{TStorage, SQLite, Memory} {
+		t.Run(string(kind), func(t *testing.T) {
+			dataPath := t.TempDir()
+			s, err := openStorage(kind, dataPath, seconds)
+			if err != nil {
+				t.Fatalf("opening storage: %v", err)
+			}
+			var rows []Row
+			for ts := int64(100); ts < 105; ts++ {
+				rows = append(rows,
+					Row{Metric: "memory_usage", Labels: web, DataPoint: DataPoint{Timestamp: ts, Value: float64(ts)}},
+					Row{Metric: "memory_usage", Labels: db, DataPoint: DataPoint{Timestamp: ts, Value: -float64(ts)}},
+					Row{Metric: "cpu_percentage", Labels: web, DataPoint: DataPoint{Timestamp: ts, Value: 1}},
+				)
+			}
+			if err := s.Write(rows); err != nil {
+				t.Fatalf("writing rows: %v", err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("closing storage: %v", err)
+			}
+
+			// the datapoints outlive the store, whatever the labels order
+			s, err = openStorage(kind, dataPath, seconds)
+			if err != nil {
+				t.Fatalf("reopening storage: %v", err)
+			}
+			defer func() {
+				_ = s.Close()
+			}()
+			dps, err := s.Select("memory_usage", []Label{web[1], web[0]}, 101, 104)
+			if err != nil {
+				t.Fatalf("selecting datapoints: %v", err)
+			}
+			want := []DataPoint{{101, 101}, {102, 102}, {103, 103}}
+			if !slices.Equal(dps, want) {
+				t.Errorf("selected %v, want %v", dps, want)
+			}
+			if dps, err := s.Select("memory_usage", web[:1], 0, 200); err != nil || len(dps) != 0 {
+				t.Errorf("selecting with a label missing = %v, %v, want no datapoints", dps, err)
+			}
+
+			p, ok := s.(pruner)
+			if ok != kind.prunes() {
+				t.Fatalf("storage prunes: %v, want %v", ok, kind.prunes())
+			}
+			if !ok {
+				return
+			}
+			if err := p.Prune(103); err != nil {
+				t.Fatalf("pruning: %v", err)
+			}
+			for _, labels := range [][]Label{web, db} {
+				dps, err := s.Select("memory_usage", labels, 0, 200)
+				if err != nil {
+					t.Fatalf("selecting datapoints: %v", err)
+				}
+				if len(dps) != 2 || dps[0].Timestamp != 103 {
+					t.Errorf("kept %v after pruning, want the datapoints from 103", dps)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenUnknownStorage(t *testing.T) {
+	if _, err := openStorage("rrd", t.TempDir(), seconds); !errors.Is(err, ErrUnknownStorage) {
+		t.Errorf("opening storage error = %v, want %v", err, ErrUnknownStorage)
+	}
+}
@@ -0,0 +1,69 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nakabonne/tstorage"
+	"math"
+)
+
+// tstorageStorage keeps the datapoints in tstorage partitions under the
+// session directory.
+type tstorageStorage struct {
+	db tstorage.Storage
+}
+
+func openTStorage(dataPath string, precision timestampPrecision) (*tstorageStorage, error) {
+	// tstorage drops the partitions older than 14 days by default, even
+	// when reopening a session long after it was recorded. Its retention
+	// goes by the partitions creation time, not by the datapoints one, so
+	// the sessions don't use it.
+	db, err := tstorage.NewStorage(
+		tstorage.WithTimestampPrecision(tstorage.TimestampPrecision(precision)),
+		tstorage.WithDataPath(dataPath),
+		tstorage.WithRetention(math.MaxInt64),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("opening tstorage: %w", err)
+	}
+	return &tstorageStorage{db: db}, nil
+}
+
+func (s *tstorageStorage) Write(rows []Row) error {
+	tsRows := make([]tstorage.Row, len(rows))
+	for i, row := range rows {
+		tsRows[i] = tstorage.Row{
+			Metric:    row.Metric,
+			Labels:    tstorageLabels(row.Labels),
+			DataPoint: tstorage.DataPoint{Timestamp: row.Timestamp, Value: row.Value},
+		}
+	}
+	return s.db.InsertRows(tsRows)
+}
+
+func (s *tstorageStorage) Select(metric string, labels []Label, start, end int64) ([]DataPoint, error) {
+	points, err := s.db.Select(metric, tstorageLabels(labels), start, end)
+	if errors.Is(err, tstorage.ErrNoDataPoints) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	dps := make([]DataPoint, len(points))
+	for i, p := range points {
+		dps[i] = DataPoint{Timestamp: p.Timestamp, Value: p.Value}
+	}
+	return dps, nil
+}
+
+func (s *tstorageStorage) Close() error {
+	return s.db.Close()
+}
+
+func tstorageLabels(labels []Label) []tstorage.Label {
+	tsLabels := make([]tstorage.Label, len(labels))
+	for i, l := range labels {
+		tsLabels[i] = tstorage.Label{Name: l.Name, Value: l.Value}
+	}
+	return tsLabels
+}
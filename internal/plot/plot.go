@@ -1,6 +1,7 @@
 package plot
 
 import (
+	"errors"
 	"fmt"
 	"github.com/eldius/docker-profiler/internal/helper"
 	"github.com/eldius/docker-profiler/internal/model"
@@ -10,12 +11,15 @@ import (
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/plotutil"
 	"gonum.org/v1/plot/vg"
+	"image/color"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"time"
 )
 
-func PlotToFile(mdps []model.MetricsDatapoint) error {
+func PlotToFile(dir string, mdps []model.MetricsDatapoint) error {
 	count := len(mdps)
 	mups := make([]float64, count)
 	mlps := make([]float64, count)
@@ -46,57 +50,61 @@ func PlotToFile(mdps []model.MetricsDatapoint) error {
 	defaults.FontSize = 18
 	defaults.Font, _ = chart.GetDefaultFont()
 
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("creating output directory: %w", err)
+	}
+	var errs []error
 	memoryFormatter := func(v interface{}) string {
 		if t, ok := v.(float64); ok {
 			return helper.FormatMemory(uint64(t))
 		}
 		return fmt.Sprintf("%v", v)
 	}
-	plotGraph("memory_usage.svg", chart.TimeSeries{
+	errs = append(errs, plotGraph(dir, "memory_usage.svg", chart.TimeSeries{
 		Name:    "Memory Usage",
 		XValues: xvalues,
 		YValues: mups,
 		Style:   defaults,
-	}, memoryFormatter)
+	}, memoryFormatter))
 
-	plotGraph("memory_limit.svg", chart.TimeSeries{
+	errs = append(errs, plotGraph(dir, "memory_limit.svg", chart.TimeSeries{
 		Name:    "Memory Limit",
 		XValues: xvalues,
 		YValues: mlps,
 		Style:   defaults,
-	}, memoryFormatter)
+	}, memoryFormatter))
 
-	plotGraph("cpu_online_count.svg", chart.TimeSeries{
+	errs = append(errs, plotGraph(dir, "cpu_online_count.svg", chart.TimeSeries{
 		Name:    "CP Online Count",
 		XValues: xvalues,
 		YValues: cops,
 		Style:   defaults,
 	}, func(v interface{}) string {
 		return fmt.Sprintf("%v", v)
-	})
+	}))
 
-	plotGraph("cpu_usage.svg", chart.TimeSeries{
+	errs = append(errs, plotGraph(dir, "cpu_usage.svg", chart.TimeSeries{
 		Name:    "CPU Usage",
 		XValues: xvalues,
 		YValues: cups,
 		Style:   defaults,
 	}, func(v interface{}) string {
 		return fmt.Sprintf("%v", v)
-	})
+	}))
 
-	plotGraph("cpu_percentage.svg", chart.TimeSeries{
+	errs = append(errs, plotGraph(dir, "cpu_percentage.svg", chart.TimeSeries{
 		Name:    "CPU Percentage",
 		XValues: xvalues,
 		YValues: cpps,
 		Style:   defaults,
 	}, func(v interface{}) string {
 		return fmt.Sprintf("%v%%", v)
-	})
+	}))
 
-	return nil
+	return errors.Join(errs...)
 }
 
-func plotGraph(file string, c chart.Series, formatter chart.ValueFormatter) error {
+func plotGraph(dir, file string, c chart.Series, formatter chart.ValueFormatter) error {
 	style := c.GetStyle()
 
 	gridLineStyle := c.GetStyle()
@@ -133,58 +141,242 @@ func plotGraph(file string, c chart.Series, formatter chart.ValueFormatter) erro
 			c,
 		},
 	}
-	f, _ := os.Create(filepath.Join(".data", file))
-	defer func() {
+	f, err := os.Create(filepath.Join(dir, file))
+	if err != nil {
+		return fmt.Errorf("creating chart file: %w", err)
+	}
+	if err := graph.Render(chart.SVG, f); err != nil {
 		_ = f.Close()
-	}()
-	return graph.Render(chart.SVG, f)
+		return fmt.Errorf("rendering chart '%s': %w", file, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing chart '%s': %w", file, err)
+	}
+	return nil
 }
 
-func Plot(mdps []model.MetricsDatapoint) {
-	count := len(mdps)
-	memUsagePoints := make(plotter.XYs, count)
-	memLimitPoints := make(plotter.XYs, count)
-	memPercentage := make(plotter.XYs, count)
-	cpuOnlinePoints := make(plotter.XYs, count)
-	cpuUsagePoints := make(plotter.XYs, count)
-	cpuPercentPoints := make(plotter.XYs, count)
-	for i, v := range mdps {
-		//memUsagePoints[i].X = float64(i) // Index as X value
-		memUsagePoints[i].X = float64(v.Timestamp.Unix()) // Index as X value
-		memUsagePoints[i].Y = v.MemoryUsage
-
-		//memLimitPoints[i].X = float64(i)
-		memLimitPoints[i].X = float64(v.Timestamp.Unix())
-		memLimitPoints[i].Y = v.MemoryLimit
-
-		memPercentage[i].X = float64(v.Timestamp.Unix())
-		memPercentage[i].Y = helper.Percentage(uint64(v.MemoryUsage), uint64(v.MemoryLimit))
-
-		//cpuOnlinePoints[i].X = float64(i)
-		cpuOnlinePoints[i].X = float64(v.Timestamp.Unix())
-		cpuOnlinePoints[i].Y = v.CPUOnlineCount
-
-		//cpuPercentPoints[i].X = float64(i)
-		cpuPercentPoints[i].X = float64(v.Timestamp.Unix())
-		cpuPercentPoints[i].Y = v.CPUPercentage
-
-		//cpuUsagePoints[i].X = float64(i)
-		cpuUsagePoints[i].X = float64(v.Timestamp.Unix())
-		cpuUsagePoints[i].Y = v.CPUUsage
+// Plot draws the charts for the given series, one line per container,
+// into the directory (created when missing). Every chart is attempted,
+// and the failures are all reported.
+func Plot(dir string, series []model.ContainerSeries) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("creating output directory: %w", err)
 	}
-
+	var errs []error
 	memFormatter := newMemoryFormatter()
 	percentageFormatter := newPercentageFormatter()
 
-	draw(memUsagePoints, memFormatter, "Memory", "memory_usage.svg", "Memory Usage")
-	draw(memLimitPoints, memFormatter, "Memory", "memory_limit.svg", "Memory Limit")
-	draw(memPercentage, percentageFormatter, "Memory", "memory_percentage.svg", "Memory Percentage")
-	draw(cpuUsagePoints, nil, "CPU Time", "cpu_usage.svg", "CPU Usage")
-	draw(cpuOnlinePoints, nil, "Number of CPUs", "cpu_online.svg", "CPU Count")
-	draw(cpuPercentPoints, percentageFormatter, "CPU Usage %", "cpu_percentage.svg", "CPU Usage %")
+	var memUsageLines, memLimitLines, memPercentageLines, cpuOnlineLines, cpuUsageLines, cpuPercentLines []line
+	var netBytesLines, netPacketsLines []line
+	var diskBytesLines, diskOpsLines []line
+	var throttlingLines []line
+	var memWorkingSetLines []line
+	var pidsLines []line
+	var cpuModeLines []line
+	var pidsLimits []float64
+	for _, cs := range series {
+		count := len(cs.Datapoints)
+		memUsagePoints := make(plotter.XYs, count)
+		memLimitPoints := make(plotter.XYs, count)
+		memPercentage := make(plotter.XYs, count)
+		cpuOnlinePoints := make(plotter.XYs, count)
+		cpuUsagePoints := make(plotter.XYs, count)
+		cpuPercentPoints := make(plotter.XYs, count)
+		throttledPoints := make(plotter.XYs, count)
+		workingSetPoints := make(plotter.XYs, count)
+		anonPoints := make(plotter.XYs, count)
+		filePoints := make(plotter.XYs, count)
+		shmemPoints := make(plotter.XYs, count)
+		kernelStackPoints := make(plotter.XYs, count)
+		slabPoints := make(plotter.XYs, count)
+		pidsPoints := make(plotter.XYs, count)
+		cpuUserPoints := make(plotter.XYs, count)
+		cpuKernelPoints := make(plotter.XYs, count)
+		corePoints := make([]plotter.XYs, cs.Cores)
+		for i, v := range cs.Datapoints {
+			//memUsagePoints[i].X = float64(i) // Index as X value
+			memUsagePoints[i].X = timeX(v.Timestamp) // Index as X value
+			memUsagePoints[i].Y = v.MemoryUsage
+
+			//memLimitPoints[i].X = float64(i)
+			memLimitPoints[i].X = timeX(v.Timestamp)
+			memLimitPoints[i].Y = v.MemoryLimit
+
+			memPercentage[i].X = timeX(v.Timestamp)
+			memPercentage[i].Y = helper.Percentage(uint64(v.MemoryUsage), uint64(v.MemoryLimit))
+
+			//cpuOnlinePoints[i].X = float64(i)
+			cpuOnlinePoints[i].X = timeX(v.Timestamp)
+			cpuOnlinePoints[i].Y = v.CPUOnlineCount
+
+			//cpuPercentPoints[i].X = float64(i)
+			cpuPercentPoints[i].X = timeX(v.Timestamp)
+			cpuPercentPoints[i].Y = v.CPUPercentage
+
+			//cpuUsagePoints[i].X = float64(i)
+			cpuUsagePoints[i].X = timeX(v.Timestamp)
+			cpuUsagePoints[i].Y = v.CPUUsage
+
+			throttledPoints[i].X = timeX(v.Timestamp)
+			throttledPoints[i].Y = v.ThrottledPercentage
+
+			x := timeX(v.Timestamp)
+			workingSetPoints[i] = plotter.XY{X: x, Y: v.MemoryWorkingSet}
+			anonPoints[i] = plotter.XY{X: x, Y: v.MemoryAnon}
+			// the page cache already holds the shared memory (tmpfs, shm),
+			// stacking both would count it twice
+			filePoints[i] = plotter.XY{X: x, Y: math.Max(v.MemoryFile-v.MemoryShmem, 0)}
+			shmemPoints[i] = plotter.XY{X: x, Y: v.MemoryShmem}
+			kernelStackPoints[i] = plotter.XY{X: x, Y: v.MemoryKernelStack}
+			slabPoints[i] = plotter.XY{X: x, Y: v.MemorySlab}
+			pidsPoints[i] = plotter.XY{X: x, Y: v.PidsCurrent}
+			cpuUserPoints[i] = plotter.XY{X: x, Y: v.CPUUserPercentage}
+			cpuKernelPoints[i] = plotter.XY{X: x, Y: v.CPUKernelPercentage}
+			for core, p := range v.CPUPerCore {
+				if core < len(corePoints) {
+					corePoints[core] = append(corePoints[core], plotter.XY{X: x, Y: p})
+				}
+			}
+
+			if v.PidsLimit > 0 && v.PidsLimit < math.MaxInt32 && !slices.Contains(pidsLimits, v.PidsLimit) {
+				pidsLimits = append(pidsLimits, v.PidsLimit)
+			}
+		}
+
+		name := seriesName(cs)
+		memUsageLines = append(memUsageLines, line{name: name, data: memUsagePoints})
+		memLimitLines = append(memLimitLines, line{name: name, data: memLimitPoints})
+		memPercentageLines = append(memPercentageLines, line{name: name, data: memPercentage})
+		cpuOnlineLines = append(cpuOnlineLines, line{name: name, data: cpuOnlinePoints})
+		cpuUsageLines = append(cpuUsageLines, line{name: name, data: cpuUsagePoints})
+		cpuPercentLines = append(cpuPercentLines, line{name: name, data: cpuPercentPoints})
+		memWorkingSetLines = append(memWorkingSetLines, line{name: name, data: workingSetPoints})
+		pidsLines = append(pidsLines, line{name: name, data: pidsPoints})
+		cpuModeLines = append(cpuModeLines,
+			line{name: name + " user", data: cpuUserPoints},
+			line{name: name + " kernel", data: cpuKernelPoints},
+		)
+		if len(corePoints) > 0 {
+			coreLines := make([]line, len(corePoints))
+			for core, points := range corePoints {
+				coreLines[core] = line{name: fmt.Sprintf("cpu %d", core), data: points}
+			}
+			errs = append(errs, draw(dir, coreLines, percentageFormatter, "CPU Usage %", fmt.Sprintf("cpu_per_core_%s.svg", seriesFileID(cs)), fmt.Sprintf("CPU Usage per Core - %s", name)))
+		}
+		errs = append(errs, drawStacked(dir, []line{
+			{name: "anon", data: anonPoints},
+			{name: "file (excl. shmem)", data: filePoints},
+			{name: "shmem", data: shmemPoints},
+			{name: "kernel stack", data: kernelStackPoints},
+			{name: "slab", data: slabPoints},
+		}, memFormatter, "Memory", fmt.Sprintf("memory_composition_%s.svg", seriesFileID(cs)), fmt.Sprintf("Memory Composition - %s", name)))
+		throttlingLines = append(throttlingLines,
+			line{name: name + " cpu", data: cpuPercentPoints},
+			line{name: name + " throttled", data: throttledPoints},
+		)
+
+		for _, iface := range cs.Interfaces {
+			var rxBytes, txBytes, rxPackets, txPackets plotter.XYs
+			for _, v := range cs.Datapoints {
+				n, ok := v.Networks[iface]
+				if !ok {
+					continue
+				}
+				x := timeX(v.Timestamp)
+				rxBytes = append(rxBytes, plotter.XY{X: x, Y: n.RxBytesRate})
+				txBytes = append(txBytes, plotter.XY{X: x, Y: n.TxBytesRate})
+				rxPackets = append(rxPackets, plotter.XY{X: x, Y: n.RxPacketsRate})
+				txPackets = append(txPackets, plotter.XY{X: x, Y: n.TxPacketsRate})
+			}
+			netBytesLines = append(netBytesLines,
+				line{name: fmt.Sprintf("%s %s rx", name, iface), data: rxBytes},
+				line{name: fmt.Sprintf("%s %s tx", name, iface), data: txBytes},
+			)
+			netPacketsLines = append(netPacketsLines,
+				line{name: fmt.Sprintf("%s %s rx", name, iface), data: rxPackets},
+				line{name: fmt.Sprintf("%s %s tx", name, iface), data: txPackets},
+			)
+		}
+
+		for _, device := range cs.Devices {
+			var readBytes, writeBytes, readOps, writeOps plotter.XYs
+			for _, v := range cs.Datapoints {
+				b, ok := v.BlockIO[device]
+				if !ok {
+					continue
+				}
+				x := timeX(v.Timestamp)
+				readBytes = append(readBytes, plotter.XY{X: x, Y: b.ReadBytesRate})
+				writeBytes = append(writeBytes, plotter.XY{X: x, Y: b.WriteBytesRate})
+				readOps = append(readOps, plotter.XY{X: x, Y: b.ReadIOPS})
+				writeOps = append(writeOps, plotter.XY{X: x, Y: b.WriteIOPS})
+			}
+			diskBytesLines = append(diskBytesLines,
+				line{name: fmt.Sprintf("%s %s read", name, device), data: readBytes},
+				line{name: fmt.Sprintf("%s %s write", name, device), data: writeBytes},
+			)
+			diskOpsLines = append(diskOpsLines,
+				line{name: fmt.Sprintf("%s %s read", name, device), data: readOps},
+				line{name: fmt.Sprintf("%s %s write", name, device), data: writeOps},
+			)
+		}
+	}
+
+	errs = append(errs, draw(dir, memUsageLines, memFormatter, "Memory", "memory_usage.svg", "Memory Usage"))
+	errs = append(errs, draw(dir, memLimitLines, memFormatter, "Memory", "memory_limit.svg", "Memory Limit"))
+	errs = append(errs, draw(dir, memWorkingSetLines, memFormatter, "Memory", "memory_working_set.svg", "Memory Working Set"))
+	errs = append(errs, draw(dir, memPercentageLines, percentageFormatter, "Memory", "memory_percentage.svg", "Memory Percentage"))
+	errs = append(errs, draw(dir, cpuUsageLines, nil, "CPU Time", "cpu_usage.svg", "CPU Usage"))
+	errs = append(errs, draw(dir, cpuOnlineLines, nil, "Number of CPUs", "cpu_online.svg", "CPU Count"))
+	errs = append(errs, draw(dir, cpuPercentLines, percentageFormatter, "CPU Usage %", "cpu_percentage.svg", "CPU Usage %"))
+	errs = append(errs, draw(dir, pidsLines, nil, "PIDs", "pids.svg", "PIDs", pidsLimits...))
+	errs = append(errs, draw(dir, cpuModeLines, percentageFormatter, "CPU Usage %", "cpu_user_kernel.svg", "CPU User vs Kernel %"))
+	errs = append(errs, draw(dir, throttlingLines, percentageFormatter, "%", "cpu_throttling.svg", "CPU Usage % vs Throttled Periods %"))
+	if len(netBytesLines) > 0 {
+		errs = append(errs, draw(dir, netBytesLines, newByteRateFormatter(), "Throughput", "network_throughput.svg", "Network Throughput"))
+		errs = append(errs, draw(dir, netPacketsLines, nil, "Packets/s", "network_packets.svg", "Network Packets"))
+	}
+	if len(diskBytesLines) > 0 {
+		errs = append(errs, draw(dir, diskBytesLines, newByteRateFormatter(), "Throughput", "disk_throughput.svg", "Disk Throughput"))
+		errs = append(errs, draw(dir, diskOpsLines, nil, "IOPS", "disk_iops.svg", "Disk IOPS"))
+	}
+	return errors.Join(errs...)
+}
+
+// line is a named set of points drawn as one line in a chart.
+type line struct {
+	name string
+	data plotter.XYs
 }
 
-func draw(data plotter.XYer, yFormatter plot.Ticker, yLabel, file, title string, marks ...float64) {
+func seriesName(cs model.ContainerSeries) string {
+	name := cs.Name
+	if name == "" {
+		name = cs.ShortID()
+	}
+	if !cs.StartedAt.IsZero() {
+		name = fmt.Sprintf("%s (%s)", name, cs.StartedAt.Local().Format(time.DateTime))
+	}
+	return name
+}
+
+// timeX converts the time to the X axis value, keeping sub-second
+// precision.
+func timeX(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// seriesFileID identifies the container lifecycle in chart file names.
+func seriesFileID(cs model.ContainerSeries) string {
+	if cs.StartedAt.IsZero() {
+		return cs.ShortID()
+	}
+	return fmt.Sprintf("%s_%d", cs.ShortID(), cs.StartedAt.Unix())
+}
+
+// drawStacked draws the layers stacked on top of each other, the first
+// one at the bottom.
+func drawStacked(dir string, layers []line, yFormatter plot.Ticker, yLabel, file, title string) error {
 	fmt.Printf("Printing chart '%s'...\n", title)
 
 	xticks := plot.TimeTicks{Format: time.RFC3339}
@@ -196,22 +388,95 @@ func draw(data plotter.XYer, yFormatter plot.Ticker, yLabel, file, title string,
 	}
 	p.Y.Label.Text = yLabel
 	p.Add(plotter.NewGrid())
+	p.Legend.Top = true
 
-	line, err := plotter.NewLine(data)
-	if err != nil {
-		panic(err)
+	stacked := make([]plotter.XYs, len(layers))
+	dataCount := 0
+	for i, l := range layers {
+		stacked[i] = make(plotter.XYs, len(l.data))
+		copy(stacked[i], l.data)
+		if i > 0 {
+			for j := range stacked[i] {
+				if j < len(stacked[i-1]) {
+					stacked[i][j].Y += stacked[i-1][j].Y
+				}
+			}
+		}
+		if len(l.data) > dataCount {
+			dataCount = len(l.data)
+		}
+	}
+	p.Y.Min = 0
+	// the top layers are drawn first, so the lower ones fill over them
+	for i := len(layers) - 1; i >= 0; i-- {
+		ln, err := plotter.NewLine(stacked[i])
+		if err != nil {
+			return fmt.Errorf("drawing chart '%s': %w", title, err)
+		}
+		ln.Color = plotutil.Color(i)
+		ln.FillColor = plotutil.Color(i)
+		p.Add(ln)
+		p.Legend.Add(layers[i].name, ln)
+	}
+	width := vg.Length(dataCount/10) * vg.Inch
+	if width < 10*vg.Inch {
+		width = 10 * vg.Inch
+	}
+	if err := p.Save(width, 10*vg.Inch, filepath.Join(dir, file)); err != nil {
+		return fmt.Errorf("saving chart '%s': %w", title, err)
+	}
+	return nil
+}
+
+func draw(dir string, lines []line, yFormatter plot.Ticker, yLabel, file, title string, marks ...float64) error {
+	fmt.Printf("Printing chart '%s'...\n", title)
+
+	xticks := plot.TimeTicks{Format: time.RFC3339}
+	p := plot.New()
+	p.Title.Text = title
+	p.X.Tick.Marker = xticks
+	if yFormatter != nil {
+		p.Y.Tick.Marker = yFormatter
+	}
+	p.Y.Label.Text = yLabel
+	p.Add(plotter.NewGrid())
+	p.Legend.Top = true
+
+	dataCount := 0
+	for i, l := range lines {
+		ln, sc, err := plotter.NewLinePoints(l.data)
+		if err != nil {
+			return fmt.Errorf("drawing chart '%s': %w", title, err)
+		}
+		ln.Color = plotutil.Color(i)
+		sc.Color = plotutil.Color(i)
+		sc.Shape = plotutil.Shape(i)
+		p.Add(ln, sc)
+		p.Legend.Add(l.name, ln, sc)
+		if l.data.Len() > dataCount {
+			dataCount = l.data.Len()
+		}
 	}
-	p.Add(line)
-	_ = plotutil.AddScatters(p, data)
 	for _, m := range marks {
-		_ = plotutil.AddLines(p, plotter.NewFunction(func(f float64) float64 {
+		f := plotter.NewFunction(func(float64) float64 {
 			return m
-		}))
+		})
+		f.Color = color.RGBA{R: 255, A: 255}
+		f.Dashes = []vg.Length{vg.Points(4), vg.Points(4)}
+		p.Add(f)
+		// functions don't take part in the axis range
+		if m > p.Y.Max {
+			p.Y.Max = m * 1.05
+		}
+	}
+	width := vg.Length(dataCount/10) * vg.Inch
+	if width < 10*vg.Inch {
+		width = 10 * vg.Inch
 	}
-	dataCount := data.Len()
-	if err := p.Save(vg.Length(dataCount/10)*vg.Inch, 10*vg.Inch, filepath.Join(".data", file)); err != nil {
-		panic(err)
+	if err := p.Save(width, 10*vg.Inch, filepath.Join(dir, file)); err != nil {
+		return fmt.Errorf("saving chart '%s': %w", title, err)
 	}
+	return nil
 }
 
 func newMemoryFormatter() plot.Ticker {
@@ -226,6 +491,12 @@ func newPercentageFormatter() plot.Ticker {
 	}
 }
 
+func newByteRateFormatter() plot.Ticker {
+	return &byteRateTickerMarker{
+		Ticker: plot.DefaultTicks{},
+	}
+}
+
 type memoryTickerMarker struct {
 	Ticker plot.Ticker
 }
@@ -234,6 +505,10 @@ type percentageTickerMarker struct {
 	Ticker plot.Ticker
 }
 
+type byteRateTickerMarker struct {
+	Ticker plot.Ticker
+}
+
 func (m memoryTickerMarker) Ticks(min, max float64) []plot.Tick {
 	ticks := m.Ticker.Ticks(min, max)
 	for i := range ticks {
@@ -257,3 +532,15 @@ func (m percentageTickerMarker) Ticks(min, max float64) []plot.Tick {
 	}
 	return ticks
 }
+
+func (m byteRateTickerMarker) Ticks(min, max float64) []plot.Tick {
+	ticks := m.Ticker.Ticks(min, max)
+	for i := range ticks {
+		tick := &ticks[i]
+		if tick.Label == "" {
+			continue
+		}
+		tick.Label = helper.FormatMemory(uint64(tick.Value)) + "/s"
+	}
+	return ticks
+}
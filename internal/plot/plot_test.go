@@ -0,0 +1,113 @@
+package plot
+
+import (
+	"github.com/eldius/docker-profiler/internal/model"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// series returns the datapoints of a container profiled for a minute.
+func series(id, name string) model.ContainerSeries {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	cs := model.ContainerSeries{
+		SessionID: "20240301-100000-abcdef",
+		SessionContainer: model.SessionContainer{
+			Container:  model.Container{ID: id, Name: name, StartedAt: start},
+			Interfaces: []string{"eth0"},
+			Devices:    []string{"8:0"},
+			Cores:      2,
+		},
+	}
+	for i := 0; i < 60; i++ {
+		cs.Datapoints = append(cs.Datapoints, model.MetricsDatapoint{
+			Timestamp:         start.Add(time.Duration(i) * time.Second),
+			MemoryUsage:       float64(100+i) * 1024 * 1024,
+			MemoryLimit:       512 * 1024 * 1024,
+			MemoryWorkingSet:  float64(80+i) * 1024 * 1024,
+			MemoryAnon:        60 * 1024 * 1024,
+			MemoryFile:        30 * 1024 * 1024,
+			MemoryShmem:       5 * 1024 * 1024,
+			CPUOnlineCount:    2,
+			CPUPercentage:     float64(i % 100),
+			CPUUserPercentage: float64(i%100) / 2,
+			CPUPerCore:        []float64{float64(i % 50), float64(i % 30)},
+			PidsCurrent:       7,
+			PidsLimit:         100,
+			Networks: map[string]model.NetworkDatapoint{
+				"eth0": {RxBytesRate: 1000, TxBytesRate: 500},
+			},
+			BlockIO: map[string]model.BlockIODatapoint{
+				"8:0": {ReadBytesRate: 4096, WriteIOPS: 2},
+			},
+		})
+	}
+	return cs
+}
+
+func TestPlot(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "charts")
+	list := []model.ContainerSeries{
+		series("aaa111aaa111aaa1", "web"),
+		series("bbb222bbb222bbb2", "db"),
+	}
+	if err := Plot(dir, list); err != nil {
+		t.Fatalf("plotting: %v", err)
+	}
+
+	web := seriesFileID(list[0])
+	for _, file := range []string{
+		"memory_usage.svg",
+		"memory_working_set.svg",
+		"cpu_percentage.svg",
+		"cpu_user_kernel.svg",
+		"pids.svg",
+		"network_throughput.svg",
+		"disk_iops.svg",
+		"memory_composition_" + web + ".svg",
+		"cpu_per_core_" + web + ".svg",
+	} {
+		info, err := os.Stat(filepath.Join(dir, file))
+		if err != nil {
+			t.Errorf("chart not rendered: %v", err)
+			continue
+		}
+		if info.Size() == 0 {
+			t.Errorf("chart '%s' is empty", file)
+		}
+	}
+}
+
+func TestPlotUnwritableDirectory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Plot(filepath.Join(file, "charts"), []model.ContainerSeries{series("aaa111aaa111aaa1", "web")}); err == nil {
+		t.Error("plotting under a file succeeded, want an error")
+	}
+}
+
+func TestPlotPidsLimit(t *testing.T) {
+	dir := t.TempDir()
+	web := series("aaa111aaa111aaa1", "web")
+	// no limit, as the daemon reports it on cgroup v1
+	db := series("bbb222bbb222bbb2", "db")
+	for i := range db.Datapoints {
+		db.Datapoints[i].PidsLimit = math.MaxUint64
+	}
+	if err := Plot(dir, []model.ContainerSeries{web, db}); err != nil {
+		t.Fatalf("plotting: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "pids.svg"))
+	if err != nil {
+		t.Fatalf("reading pids chart: %v", err)
+	}
+	// the limit mark is labelled with its value on the axis
+	if !strings.Contains(string(b), ">100<") {
+		t.Error("pids chart has no mark at the limit")
+	}
+}
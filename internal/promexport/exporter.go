@@ -0,0 +1,228 @@
+package promexport
+
+import (
+	"github.com/eldius/docker-profiler/internal/docker"
+	"github.com/eldius/docker-profiler/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const namespace = "docker_profiler"
+
+// containerLabels are the labels of every exported series.
+var containerLabels = []string{"name", "id", "image"}
+
+// metric is a series with one value per container.
+type metric struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	value     func(s model.ContainerStats) float64
+}
+
+var metrics = []metric{
+	newMetric("memory_usage_bytes", "Memory usage, page cache included.", prometheus.GaugeValue, func(s model.ContainerStats) float64 {
+		return float64(s.MemoryStats.Usage)
+	}),
+	newMetric("memory_limit_bytes", "Memory limit.", prometheus.GaugeValue, func(s model.ContainerStats) float64 {
+		return float64(s.MemoryStats.Limit)
+	}),
+	newMetric("memory_working_set_bytes", "Memory usage without the inactive page cache.", prometheus.GaugeValue, func(s model.ContainerStats) float64 {
+		return float64(s.MemoryWorkingSet())
+	}),
+	newMetric("cpu_usage_percent", "CPU usage percentage since the previous sample.", prometheus.GaugeValue, func(s model.ContainerStats) float64 {
+		return s.CPUUsagePercentage()
+	}),
+	newMetric("cpu_user_percent", "CPU usage percentage in user mode since the previous sample.", prometheus.GaugeValue, func(s model.ContainerStats) float64 {
+		return s.CPUUserPercentage()
+	}),
+	newMetric("cpu_kernel_percent", "CPU usage percentage in kernel mode since the previous sample.", prometheus.GaugeValue, func(s model.ContainerStats) float64 {
+		return s.CPUKernelPercentage()
+	}),
+	newMetric("cpu_online", "Number of online CPUs.", prometheus.GaugeValue, func(s model.ContainerStats) float64 {
+		return float64(s.CPUStats.OnlineCPUs)
+	}),
+	newMetric("cpu_usage_seconds_total", "Cumulative CPU time consumed.", prometheus.CounterValue, func(s model.ContainerStats) float64 {
+		return float64(s.CPUStats.CPUUsage.TotalUsage) / 1e9
+	}),
+	newMetric("cpu_throttled_percent", "Percentage of periods throttled since the previous sample.", prometheus.GaugeValue, func(s model.ContainerStats) float64 {
+		return s.CPUThrottledPercentage()
+	}),
+	newMetric("cpu_throttling_periods_total", "Cumulative CPU enforcement periods.", prometheus.CounterValue, func(s model.ContainerStats) float64 {
+		return float64(s.CPUStats.ThrottlingData.Periods)
+	}),
+	newMetric("cpu_throttled_periods_total", "Cumulative CPU enforcement periods throttled.", prometheus.CounterValue, func(s model.ContainerStats) float64 {
+		return float64(s.CPUStats.ThrottlingData.ThrottledPeriods)
+	}),
+	newMetric("cpu_throttled_seconds_total", "Cumulative time throttled.", prometheus.CounterValue, func(s model.ContainerStats) float64 {
+		return float64(s.CPUStats.ThrottlingData.ThrottledTime) / 1e9
+	}),
+	newMetric("pids_current", "Number of pids in the container cgroup.", prometheus.GaugeValue, func(s model.ContainerStats) float64 {
+		return float64(s.PidsStats.Current)
+	}),
+	newMetric("pids_limit", "Pids limit (0 means no limit).", prometheus.GaugeValue, func(s model.ContainerStats) float64 {
+		return float64(s.PidsStats.Limit)
+	}),
+}
+
+var (
+	memoryCompositionDesc = newDesc("memory_composition_bytes", "Memory usage by kind (anon, file, shmem, kernel_stack, slab).", "kind")
+	cpuCoreDesc           = newDesc("cpu_core_usage_percent", "CPU usage percentage of a core since the previous sample.", "cpu")
+
+	networkDescs = map[string]*prometheus.Desc{
+		"rx_bytes":   newDesc("network_receive_bytes_total", "Cumulative bytes received.", "interface"),
+		"rx_packets": newDesc("network_receive_packets_total", "Cumulative packets received.", "interface"),
+		"rx_errors":  newDesc("network_receive_errors_total", "Cumulative receive errors.", "interface"),
+		"rx_dropped": newDesc("network_receive_dropped_total", "Cumulative packets dropped on receive.", "interface"),
+		"tx_bytes":   newDesc("network_transmit_bytes_total", "Cumulative bytes transmitted.", "interface"),
+		"tx_packets": newDesc("network_transmit_packets_total", "Cumulative packets transmitted.", "interface"),
+		"tx_errors":  newDesc("network_transmit_errors_total", "Cumulative transmit errors.", "interface"),
+		"tx_dropped": newDesc("network_transmit_dropped_total", "Cumulative packets dropped on transmit.", "interface"),
+	}
+	blkioDescs = map[string]*prometheus.Desc{
+		"read_bytes":  newDesc("blkio_read_bytes_total", "Cumulative bytes read.", "device"),
+		"write_bytes": newDesc("blkio_write_bytes_total", "Cumulative bytes written.", "device"),
+		"read_ops":    newDesc("blkio_read_ops_total", "Cumulative read operations.", "device"),
+		"write_ops":   newDesc("blkio_write_ops_total", "Cumulative write operations.", "device"),
+	}
+)
+
+// Exporter exposes the latest stats sample of every profiled container
+// in the Prometheus text format. It's a profiling sink, so the series
+// follow the stats streams as they arrive and go away with them.
+type Exporter struct {
+	mu sync.Mutex
+	// samples are keyed by container ID, as the series have no lifecycle
+	// label: a restarted container replaces its previous lifecycle.
+	samples map[string]sample
+}
+
+// sample is the latest stats sample of a container lifecycle.
+type sample struct {
+	sc    model.SessionContainer
+	stats model.ContainerStats
+}
+
+var (
+	_ docker.Sink          = (*Exporter)(nil)
+	_ prometheus.Collector = (*Exporter)(nil)
+)
+
+// New creates an exporter with no containers.
+func New() *Exporter {
+	return &Exporter{
+		samples: make(map[string]sample),
+	}
+}
+
+// Handler serves the exported metrics.
+func (e *Exporter) Handler() http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
+
+func (e *Exporter) Observe(sc model.SessionContainer, stats model.ContainerStats) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.samples[sc.ID] = sample{sc: sc, stats: stats}
+	return nil
+}
+
+// Forget drops the container series, unless a later lifecycle of the
+// container replaced them already.
+func (e *Exporter) Forget(c model.Container) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if smp, ok := e.samples[c.ID]; ok && smp.sc.Segment() == c.Segment() {
+		delete(e.samples, c.ID)
+	}
+}
+
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range metrics {
+		ch <- m.desc
+	}
+	ch <- memoryCompositionDesc
+	ch <- cpuCoreDesc
+	for _, d := range networkDescs {
+		ch <- d
+	}
+	for _, d := range blkioDescs {
+		ch <- d
+	}
+}
+
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, smp := range e.samples {
+		s := smp.stats
+		labels := []string{smp.sc.Name, smp.sc.ID, smp.sc.Image}
+		with := func(v string) []string {
+			return append(labels[:len(labels):len(labels)], v)
+		}
+
+		for _, m := range metrics {
+			ch <- prometheus.MustNewConstMetric(m.desc, m.valueType, m.value(s), labels...)
+		}
+
+		mem := s.MemoryBreakdown()
+		for kind, v := range map[string]uint64{
+			"anon":         mem.Anon,
+			"file":         mem.File,
+			"shmem":        mem.Shmem,
+			"kernel_stack": mem.KernelStack,
+			"slab":         mem.Slab,
+		} {
+			ch <- prometheus.MustNewConstMetric(memoryCompositionDesc, prometheus.GaugeValue, float64(v), with(kind)...)
+		}
+
+		for core, v := range s.CPUPerCorePercentage() {
+			ch <- prometheus.MustNewConstMetric(cpuCoreDesc, prometheus.GaugeValue, v, with(strconv.Itoa(core))...)
+		}
+
+		for name, n := range s.Networks {
+			for key, v := range map[string]uint64{
+				"rx_bytes":   n.RxBytes,
+				"rx_packets": n.RxPackets,
+				"rx_errors":  n.RxErrors,
+				"rx_dropped": n.RxDropped,
+				"tx_bytes":   n.TxBytes,
+				"tx_packets": n.TxPackets,
+				"tx_errors":  n.TxErrors,
+				"tx_dropped": n.TxDropped,
+			} {
+				ch <- prometheus.MustNewConstMetric(networkDescs[key], prometheus.CounterValue, float64(v), with(name)...)
+			}
+		}
+
+		for device, b := range s.BlockIO() {
+			for key, v := range map[string]uint64{
+				"read_bytes":  b.ReadBytes,
+				"write_bytes": b.WriteBytes,
+				"read_ops":    b.ReadOps,
+				"write_ops":   b.WriteOps,
+			} {
+				ch <- prometheus.MustNewConstMetric(blkioDescs[key], prometheus.CounterValue, float64(v), with(device)...)
+			}
+		}
+	}
+}
+
+func newMetric(name, help string, valueType prometheus.ValueType, value func(s model.ContainerStats) float64) metric {
+	return metric{
+		desc:      newDesc(name, help),
+		valueType: valueType,
+		value:     value,
+	}
+}
+
+func newDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, append(containerLabels[:len(containerLabels):len(containerLabels)], labels...), nil)
+}
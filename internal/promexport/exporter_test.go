@@ -0,0 +1,107 @@
+package promexport
+
+import (
+	"github.com/docker/docker/api/types"
+	"github.com/eldius/docker-profiler/internal/model"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lifecycle returns the web container started at the given minute.
+func lifecycle(minute int) model.SessionContainer {
+	return model.SessionContainer{
+		Container: model.Container{
+			ID:        "aaa111",
+			Name:      "web",
+			StartedAt: time.Date(2024, 3, 1, 10, minute, 0, 0, time.UTC),
+		},
+		Image: "alpine",
+	}
+}
+
+func stats(usage uint64) model.ContainerStats {
+	var s model.ContainerStats
+	s.MemoryStats.Usage = usage
+	s.Networks = map[string]types.NetworkStats{"eth0": {RxBytes: 1}}
+	return s
+}
+
+// scrape fetches the exported metrics, failing on an error status.
+func scrape(t *testing.T, e *Exporter) string {
+	t.Helper()
+	srv := httptest.NewServer(e.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("scraping: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading scrape: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("scrape status = %d: %s", resp.StatusCode, body)
+	}
+	return string(body)
+}
+
+// memoryUsage returns the memory usage series of the scrape.
+func memoryUsage(body string) []string {
+	var series []string
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "docker_profiler_memory_usage_bytes{") {
+			series = append(series, line)
+		}
+	}
+	return series
+}
+
+func TestScrapeAfterRestart(t *testing.T) {
+	e := New()
+	first, second := lifecycle(0), lifecycle(5)
+	if err := e.Observe(first, stats(100)); err != nil {
+		t.Fatal(err)
+	}
+	// the new lifecycle starts before the previous one is forgotten
+	if err := e.Observe(second, stats(200)); err != nil {
+		t.Fatal(err)
+	}
+
+	series := memoryUsage(scrape(t, e))
+	if len(series) != 1 || !strings.HasSuffix(series[0], " 200") {
+		t.Fatalf("memory usage series = %v, want the restarted container one", series)
+	}
+
+	e.Forget(first.Container)
+	if series := memoryUsage(scrape(t, e)); len(series) != 1 {
+		t.Errorf("forgetting the previous lifecycle dropped the new one: %v", series)
+	}
+	e.Forget(second.Container)
+	if series := memoryUsage(scrape(t, e)); len(series) != 0 {
+		t.Errorf("memory usage series = %v, want none once forgotten", series)
+	}
+}
+
+func TestScrapeLabels(t *testing.T) {
+	e := New()
+	if err := e.Observe(lifecycle(0), stats(100)); err != nil {
+		t.Fatal(err)
+	}
+	body := scrape(t, e)
+	for _, want := range []string{
+		`docker_profiler_memory_usage_bytes{id="aaa111",image="alpine",name="web"} 100`,
+		`docker_profiler_network_receive_bytes_total{id="aaa111",image="alpine",interface="eth0",name="web"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("scrape is missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package report
+
+import (
+	"fmt"
+	"github.com/eldius/docker-profiler/internal/helper"
+	"github.com/eldius/docker-profiler/internal/model"
+	"io"
+)
+
+// Options tunes how the summary flags problems.
+type Options struct {
+	// ThrottlingThreshold is the throttled periods percentage above which
+	// a session gets flagged.
+	ThrottlingThreshold float64
+}
+
+// SessionSummary summarizes the series of a profiling session.
+type SessionSummary struct {
+	SessionID  string
+	Containers []ContainerSummary
+	// Throttled is set when any container went over the throttling
+	// threshold.
+	Throttled bool
+}
+
+// ContainerSummary summarizes the series of a container lifecycle.
+type ContainerSummary struct {
+	model.SessionContainer
+	Samples          int
+	MaxMemoryUsage   float64
+	AvgCPUPercentage float64
+	MaxCPUPercentage float64
+	MaxThrottled     float64
+	OverallThrottled float64
+	ThrottledSamples int
+	OverThreshold    bool
+}
+
+// Summarize builds the summary of the series, grouped by session.
+func Summarize(series []model.ContainerSeries, opts Options) []SessionSummary {
+	var summaries []SessionSummary
+	index := make(map[string]int)
+	for _, cs := range series {
+		i, ok := index[cs.SessionID]
+		if !ok {
+			summaries = append(summaries, SessionSummary{SessionID: cs.SessionID})
+			i = len(summaries) - 1
+			index[cs.SessionID] = i
+		}
+		c := summarizeContainer(cs, opts)
+		summaries[i].Containers = append(summaries[i].Containers, c)
+		if c.OverThreshold {
+			summaries[i].Throttled = true
+		}
+	}
+	return summaries
+}
+
+func summarizeContainer(cs model.ContainerSeries, opts Options) ContainerSummary {
+	c := ContainerSummary{
+		SessionContainer: cs.SessionContainer,
+		Samples:          len(cs.Datapoints),
+	}
+	if len(cs.Datapoints) == 0 {
+		return c
+	}
+
+	var cpuTotal float64
+	for _, d := range cs.Datapoints {
+		c.MaxMemoryUsage = max(c.MaxMemoryUsage, d.MemoryUsage)
+		c.MaxCPUPercentage = max(c.MaxCPUPercentage, d.CPUPercentage)
+		c.MaxThrottled = max(c.MaxThrottled, d.ThrottledPercentage)
+		cpuTotal += d.CPUPercentage
+		if d.ThrottledPercentage > opts.ThrottlingThreshold {
+			c.ThrottledSamples++
+		}
+	}
+	c.AvgCPUPercentage = cpuTotal / float64(len(cs.Datapoints))
+
+	first, last := cs.Datapoints[0], cs.Datapoints[len(cs.Datapoints)-1]
+	if periods := last.ThrottlingPeriods - first.ThrottlingPeriods; periods > 0 {
+		c.OverallThrottled = (last.ThrottledPeriods - first.ThrottledPeriods) / periods * 100
+	}
+	c.OverThreshold = c.MaxThrottled > opts.ThrottlingThreshold
+	return c
+}
+
+// Print writes the summaries in a human readable format.
+func Print(w io.Writer, summaries []SessionSummary, opts Options) {
+	for _, s := range summaries {
+		_, _ = fmt.Fprintln(w, "=== summary")
+		_, _ = fmt.Fprintf(w, "session:         %s\n", s.SessionID)
+		if s.Throttled {
+			_, _ = fmt.Fprintf(w, "WARNING:         CPU throttling went over %01.2f%%\n", opts.ThrottlingThreshold)
+		}
+		for _, c := range s.Containers {
+			_, _ = fmt.Fprintln(w, "---")
+			_, _ = fmt.Fprintf(w, "container:       %s (%s)\n", c.Name, c.ShortID())
+			_, _ = fmt.Fprintf(w, "samples:         %d\n", c.Samples)
+			_, _ = fmt.Fprintf(w, "max memory:      %s\n", helper.FormatMemory(uint64(c.MaxMemoryUsage)))
+			_, _ = fmt.Fprintf(w, "avg cpu:         %01.2f%%\n", c.AvgCPUPercentage)
+			_, _ = fmt.Fprintf(w, "max cpu:         %01.2f%%\n", c.MaxCPUPercentage)
+			_, _ = fmt.Fprintf(w, "throttled:       %01.2f%% overall, %01.2f%% max\n", c.OverallThrottled, c.MaxThrottled)
+			if c.OverThreshold {
+				_, _ = fmt.Fprintf(w, "throttled over:  %01.2f%% in %d samples\n", opts.ThrottlingThreshold, c.ThrottledSamples)
+			}
+			if c.Exit != nil {
+				_, _ = fmt.Fprintf(w, "exit code:       %d\n", c.Exit.Code)
+				_, _ = fmt.Fprintf(w, "oom killed:      %v\n", c.Exit.OOMKilled)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package report
+
+import (
+	"bytes"
+	"github.com/eldius/docker-profiler/internal/model"
+	"strings"
+	"testing"
+)
+
+// series returns the series of the container with the throttled
+// percentages, every sample adding 100 periods.
+func series(session, name string, throttled ...float64) model.ContainerSeries {
+	cs := model.ContainerSeries{
+		SessionID:        session,
+		SessionContainer: model.SessionContainer{Container: model.Container{ID: name + "-id", Name: name}},
+	}
+	var throttledPeriods float64
+	for i, pct := range throttled {
+		throttledPeriods += pct
+		cs.Datapoints = append(cs.Datapoints, model.MetricsDatapoint{
+			MemoryUsage:         float64(100 * (i + 1)),
+			CPUPercentage:       float64(10 * (i + 1)),
+			ThrottledPercentage: pct,
+			ThrottlingPeriods:   float64(100 * (i + 1)),
+			ThrottledPeriods:    throttledPeriods,
+		})
+	}
+	return cs
+}
+
+func TestSummarize(t *testing.T) {
+	opts := Options{ThrottlingThreshold: 25}
+	summaries := Summarize([]model.ContainerSeries{
+		series("s1", "web", 0, 10, 50, 30),
+		series("s1", "db", 0, 5, 20),
+		series("s2", "db", 0, 5),
+	}, opts)
+	if len(summaries) != 2 {
+		t.Fatalf("summarized %d sessions, want 2", len(summaries))
+	}
+	if !summaries[0].Throttled || summaries[1].Throttled {
+		t.Errorf("throttled sessions = %v %v, want only s1", summaries[0].Throttled, summaries[1].Throttled)
+	}
+
+	web := summaries[0].Containers[0]
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"samples", float64(web.Samples), 4},
+		{"max memory", web.MaxMemoryUsage, 400},
+		{"avg cpu", web.AvgCPUPercentage, 25},
+		{"max cpu", web.MaxCPUPercentage, 40},
+		{"max throttled", web.MaxThrottled, 50},
+		// (10+50+30) throttled out of 300 periods since the first sample
+		{"overall throttled", web.OverallThrottled, 30},
+		{"throttled samples", float64(web.ThrottledSamples), 2},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("web %s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+	if !web.OverThreshold || summaries[0].Containers[1].OverThreshold {
+		t.Errorf("over threshold = web %v, db %v, want only web", web.OverThreshold, summaries[0].Containers[1].OverThreshold)
+	}
+}
+
+func TestPrintFlagsThrottling(t *testing.T) {
+	opts := Options{ThrottlingThreshold: 25}
+	var buf bytes.Buffer
+	Print(&buf, Summarize([]model.ContainerSeries{series("s1", "web", 0, 50)}, opts), opts)
+	for _, want := range []string{"WARNING:         CPU throttling went over 25.00%", "throttled over:  25.00% in 1 samples"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("summary is missing %q:\n%s", want, buf.String())
+		}
+	}
+
+	buf.Reset()
+	Print(&buf, Summarize([]model.ContainerSeries{series("s1", "web", 0, 10)}, opts), opts)
+	if strings.Contains(buf.String(), "WARNING") {
+		t.Errorf("summary under the threshold is flagged:\n%s", buf.String())
+	}
+}